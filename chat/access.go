@@ -0,0 +1,68 @@
+package chat
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"github.com/eshyong/chatapp/chat/models"
+)
+
+// Returns the name of the logged in user. Routes wrapped in checkAuthentication always have one.
+func (app *Application) currentUser(r *http.Request) string {
+	userInfo, err := app.authService.GetUserInfo(r)
+	if err != nil {
+		return ""
+	}
+	return userInfo.UserName
+}
+
+// Finds a room by name, as long as the user is allowed to see it
+func (app *Application) findChatRoom(userName, roomName string) (*models.ChatRoom, *appError) {
+	roomModel, err := app.repository.FindChatRoomByName(roomName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, newAppError(http.StatusNotFound, "Could not find room with that name")
+		}
+		log.Println(err)
+		return nil, internalError()
+	}
+	if appErr := app.checkRoomAccess(userName, roomModel); appErr != nil {
+		return nil, appErr
+	}
+	return roomModel, nil
+}
+
+// Archived rooms can still be read, but nothing in them can change
+func checkNotArchived(roomModel *models.ChatRoom) *appError {
+	if roomModel.Archived {
+		return newAppError(http.StatusForbidden, "This room has been archived")
+	}
+	return nil
+}
+
+func (app *Application) checkRoomWritable(roomId int) *appError {
+	roomModel, err := app.repository.FindChatRoomById(roomId)
+	if err != nil {
+		log.Println(err)
+		return internalError()
+	}
+	return checkNotArchived(roomModel)
+}
+
+// Private rooms, including direct conversations, can only be seen by their members. Everyone else is told the
+// room doesn't exist, so that private rooms can't be discovered by guessing names.
+func (app *Application) checkRoomAccess(userName string, roomModel *models.ChatRoom) *appError {
+	if roomModel.Visibility == models.VisibilityPublic {
+		return nil
+	}
+	isMember, err := app.repository.IsRoomMember(userName, roomModel.Id)
+	if err != nil {
+		log.Println(err)
+		return internalError()
+	}
+	if !isMember {
+		return newAppError(http.StatusNotFound, "Could not find room with that name")
+	}
+	return nil
+}
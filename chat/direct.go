@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/eshyong/chatapp/chat/utils"
+)
+
+const (
+	// Names of direct conversations start with this prefix, which regular rooms can't use
+	directRoomPrefix = "dm-"
+	// Largest number of people in a direct conversation, including the person who starts it
+	maxDirectRoomSize = 8
+)
+
+// Direct conversations are named after their members, so that starting a conversation with the same people
+// always finds the same room. The names are hashed to keep them a reasonable length, and so that user names with
+// unusual characters can't collide.
+func directRoomName(members []string) string {
+	hash := sha256.Sum256([]byte(strings.Join(members, "\x00")))
+	return directRoomPrefix + hex.EncodeToString(hash[:16])
+}
+
+// Finds or creates a direct conversation between the current user and the given participants
+func (app *Application) createDirectRoomHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Println("POST /api/direct")
+		userName := app.currentUser(r)
+		createRequest := &models.CreateDirectRoomRequest{}
+		if err := utils.UnmarshalJsonRequest(r, createRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The current user is always a member, and duplicates are ignored
+		seen := map[string]bool{userName: true}
+		members := []string{userName}
+		for _, participant := range createRequest.Participants {
+			if participant != "" && !seen[participant] {
+				seen[participant] = true
+				members = append(members, participant)
+			}
+		}
+		if len(members) < 2 {
+			http.Error(w, `"participants" must include at least one other user`, http.StatusBadRequest)
+			return
+		}
+		if len(members) > maxDirectRoomSize {
+			http.Error(w, "Too many participants", http.StatusBadRequest)
+			return
+		}
+		sort.Strings(members)
+
+		existing, err := app.repository.FindExistingUserNames(members)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, defaultErrorMessage, http.StatusInternalServerError)
+			return
+		}
+		if len(existing) != len(members) {
+			http.Error(w, "Could not find all of the participants", http.StatusBadRequest)
+			return
+		}
+
+		roomModel, err := app.repository.CreateDirectRoom(directRoomName(members), userName, members)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, defaultErrorMessage, http.StatusInternalServerError)
+			return
+		}
+		utils.WriteJsonResponse(w, roomModel)
+	})
+}
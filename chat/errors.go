@@ -0,0 +1,29 @@
+package chat
+
+import (
+	"net/http"
+	"time"
+)
+
+// An error that can be reported to the user either as an HTTP response or as a websocket error message
+type appError struct {
+	Code    int
+	Message string
+	// For errors caused by sending too quickly, how long the client should wait before trying again
+	RetryAfter time.Duration
+}
+
+func (err *appError) Error() string {
+	return err.Message
+}
+
+func newAppError(code int, message string) *appError {
+	return &appError{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func internalError() *appError {
+	return newAppError(http.StatusInternalServerError, defaultErrorMessage)
+}
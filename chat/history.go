@@ -0,0 +1,128 @@
+package chat
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/eshyong/chatapp/chat/repository"
+	"github.com/eshyong/chatapp/chat/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Largest page of missed messages sent when resuming. The repository caps it to its own maximum page size.
+	maxResumeLimit = 200
+)
+
+// Reads a history query from the "before", "after" and "limit" URL parameters
+func parseHistoryQuery(values url.Values) (*models.HistoryQuery, error) {
+	query := &models.HistoryQuery{}
+	params := map[string]*int{
+		"before": &query.Before,
+		"after":  &query.After,
+		"limit":  &query.Limit,
+	}
+	for name, dest := range params {
+		value := values.Get(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.New(`"` + name + `" must be a number`)
+		}
+		*dest = n
+	}
+	if err := validateHistoryQuery(query); err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// Reads the history query for the first page sent after joining a room. Besides the usual parameters, the join
+// URL can have a "lastSeen" message ID, which clients use to pick up where they left off after reconnecting. The
+// server then sends everything after that message, up to the maximum page size. If there are more, the page has
+// HasMore set, and the client can request the rest with "after".
+func parseJoinHistoryQuery(values url.Values) (*models.HistoryQuery, error) {
+	query, err := parseHistoryQuery(values)
+	if err != nil {
+		return nil, err
+	}
+	lastSeen := values.Get("lastSeen")
+	if lastSeen == "" {
+		return query, nil
+	}
+	if query.Before > 0 || query.After > 0 {
+		return nil, errors.New(`"lastSeen" can't be combined with "before" or "after"`)
+	}
+	query.After, err = strconv.Atoi(lastSeen)
+	if err != nil || query.After < 0 {
+		return nil, errors.New(`"lastSeen" must be a message ID`)
+	}
+	if query.Limit == 0 {
+		query.Limit = maxResumeLimit
+	}
+	return query, nil
+}
+
+func validateHistoryQuery(query *models.HistoryQuery) error {
+	if query.Before < 0 || query.After < 0 || query.Limit < 0 {
+		return errors.New(`"before", "after" and "limit" must be positive numbers`)
+	}
+	if query.Before > 0 && query.After > 0 {
+		return errors.New(`Only one of "before" and "after" can be set`)
+	}
+	return nil
+}
+
+func (app *Application) listMessagesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomName := mux.Vars(r)["name"]
+		log.Println("GET /api/chatroom/" + roomName + "/messages")
+		query, err := parseHistoryQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		roomModel, appErr := app.findChatRoom(app.currentUser(r), roomName)
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		page, err := app.repository.GetChatMessagesByRoomId(roomModel.Id, query)
+		if err != nil {
+			if err == repository.ErrUnknownCursor {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			log.Println(err)
+			http.Error(w, defaultErrorMessage, http.StatusInternalServerError)
+			return
+		}
+		utils.WriteJsonResponse(w, page)
+	})
+}
+
+// Replies to a websocket request for more chat history
+func (app *Application) handleHistoryRequest(req *clientRequest, query *models.HistoryQuery) {
+	if err := validateHistoryQuery(query); err != nil {
+		req.replyError(err.Error())
+		return
+	}
+	page, err := app.repository.GetChatMessagesByRoomId(req.room.roomId, query)
+	if err != nil {
+		if err == repository.ErrUnknownCursor {
+			req.replyError(err.Error())
+			return
+		}
+		log.Println(err)
+		req.replyError(defaultErrorMessage)
+		return
+	}
+	req.reply(newServerMessage(models.WsTypeHistory, page))
+}
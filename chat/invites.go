@@ -0,0 +1,163 @@
+package chat
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/eshyong/chatapp/chat/repository"
+	"github.com/eshyong/chatapp/chat/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultInviteExpiry = 24 * time.Hour
+	maxInviteExpiry     = 30 * 24 * time.Hour
+	// Invite tokens are random, so they can't be guessed
+	inviteTokenBytes = 16
+)
+
+func newInviteToken() (string, error) {
+	token := make([]byte, inviteTokenBytes)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// Lets owners create and list invites to their rooms
+func (app *Application) invitesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomName := mux.Vars(r)["name"]
+		log.Println(r.Method + " /api/chatroom/" + roomName + "/invites")
+		userName := app.currentUser(r)
+		roomModel, appErr := app.findInviteRoom(userName, roomName)
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			invites, err := app.repository.GetInvites(roomModel.Id)
+			if err != nil {
+				log.Println(err)
+				http.Error(w, defaultErrorMessage, http.StatusInternalServerError)
+				return
+			}
+			utils.WriteJsonResponse(w, invites)
+		case "POST":
+			createRequest := &models.CreateInviteRequest{}
+			if err := utils.UnmarshalJsonRequest(r, createRequest); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			invite, appErr := app.createInvite(userName, roomModel, createRequest)
+			if appErr != nil {
+				http.Error(w, appErr.Message, appErr.Code)
+				return
+			}
+			utils.WriteJsonResponse(w, invite)
+		}
+	})
+}
+
+func (app *Application) revokeInviteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		log.Println("DELETE /api/chatroom/" + vars["name"] + "/invites/" + vars["token"])
+		roomModel, appErr := app.findInviteRoom(app.currentUser(r), vars["name"])
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		if err := app.repository.RevokeInvite(roomModel.Id, vars["token"]); err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "Could not find an invite with that token", http.StatusNotFound)
+				return
+			}
+			log.Println(err)
+			http.Error(w, defaultErrorMessage, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// Finds a room that the user is allowed to manage invites for
+func (app *Application) findInviteRoom(userName, roomName string) (*models.ChatRoom, *appError) {
+	roomModel, appErr := app.findChatRoom(userName, roomName)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if roomModel.Direct {
+		return nil, newAppError(http.StatusBadRequest, "Direct conversations don't have invites")
+	}
+	appErr = app.requireRole(userName, roomModel.Id, models.RoleOwner, "Only owners can manage invites")
+	if appErr != nil {
+		return nil, appErr
+	}
+	return roomModel, nil
+}
+
+func (app *Application) createInvite(userName string, roomModel *models.ChatRoom, createRequest *models.CreateInviteRequest) (*models.Invite, *appError) {
+	if createRequest.ExpiresInSeconds < 0 || createRequest.MaxUses < 0 {
+		return nil, newAppError(http.StatusBadRequest, `"expiresInSeconds" and "maxUses" must be positive numbers`)
+	}
+	expiry := time.Duration(createRequest.ExpiresInSeconds) * time.Second
+	if expiry == 0 {
+		expiry = defaultInviteExpiry
+	}
+	if expiry > maxInviteExpiry {
+		return nil, newAppError(http.StatusBadRequest, "Invites can last at most 30 days")
+	}
+
+	token, err := newInviteToken()
+	if err != nil {
+		log.Println(err)
+		return nil, internalError()
+	}
+	invite := &models.Invite{
+		Token:     token,
+		RoomName:  roomModel.RoomName,
+		CreatedBy: userName,
+		MaxUses:   createRequest.MaxUses,
+	}
+	if err := app.repository.CreateInvite(roomModel.Id, invite, time.Now().Add(expiry)); err != nil {
+		log.Println(err)
+		return nil, internalError()
+	}
+	return invite, nil
+}
+
+// Adds the current user to the room an invite is for, and returns the room
+func (app *Application) acceptInviteHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Println("POST /api/invite/{token}/accept")
+		roomId, err := app.repository.AcceptInvite(mux.Vars(r)["token"], app.currentUser(r))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, "This invite is invalid or has expired", http.StatusNotFound)
+				return
+			}
+			if err == repository.ErrBanned {
+				http.Error(w, "You are banned from this room", http.StatusForbidden)
+				return
+			}
+			log.Println(err)
+			http.Error(w, defaultErrorMessage, http.StatusInternalServerError)
+			return
+		}
+		roomModel, err := app.repository.FindChatRoomById(roomId)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, defaultErrorMessage, http.StatusInternalServerError)
+			return
+		}
+		utils.WriteJsonResponse(w, roomModel)
+	})
+}
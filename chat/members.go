@@ -0,0 +1,186 @@
+package chat
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/eshyong/chatapp/chat/utils"
+	"github.com/gorilla/mux"
+)
+
+// Joining a public room makes the user a member of it. Members of private rooms are added by invitation, so
+// joining one only checks that the user is already a member.
+func (app *Application) joinAsMember(userName string, roomModel *models.ChatRoom) *appError {
+	if roomModel.Visibility != models.VisibilityPublic {
+		return nil
+	}
+	if err := app.repository.AddRoomMember(userName, roomModel.Id); err != nil {
+		log.Println(err)
+		return internalError()
+	}
+	return nil
+}
+
+func (app *Application) roomMembersHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomName := mux.Vars(r)["name"]
+		log.Println(r.Method + " /api/chatroom/" + roomName + "/members")
+		userName := app.currentUser(r)
+		roomModel, appErr := app.findChatRoom(userName, roomName)
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+
+		switch r.Method {
+		case "GET":
+			members, err := app.repository.GetRoomMemberRoles(roomModel.Id)
+			if err != nil {
+				log.Println(err)
+				http.Error(w, defaultErrorMessage, http.StatusInternalServerError)
+				return
+			}
+			utils.WriteJsonResponse(w, members)
+		case "POST":
+			addRequest := &models.AddMemberRequest{}
+			if err := utils.UnmarshalJsonRequest(r, addRequest); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if appErr := app.inviteMember(userName, roomModel, addRequest.UserName); appErr != nil {
+				http.Error(w, appErr.Message, appErr.Code)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+// Adds a user to a room on behalf of one of its moderators
+func (app *Application) inviteMember(invitedBy string, roomModel *models.ChatRoom, userName string) *appError {
+	if userName == "" {
+		return newAppError(http.StatusBadRequest, `"userName" field cannot be empty`)
+	}
+	if roomModel.Direct {
+		return newAppError(http.StatusBadRequest, "Members can't be added to direct conversations")
+	}
+	appErr := app.requireRole(invitedBy, roomModel.Id, models.RoleModerator, "Only moderators can add people to this room")
+	if appErr != nil {
+		return appErr
+	}
+	if _, err := app.repository.FindUserByName(userName); err != nil {
+		if err == sql.ErrNoRows {
+			return newAppError(http.StatusNotFound, "Could not find user with that name")
+		}
+		log.Println(err)
+		return internalError()
+	}
+	banned, err := app.repository.IsBanned(userName, roomModel.Id)
+	if err != nil {
+		log.Println(err)
+		return internalError()
+	}
+	if banned {
+		return newAppError(http.StatusBadRequest, "That user is banned from this room")
+	}
+	if err := app.repository.AddRoomMember(userName, roomModel.Id); err != nil {
+		log.Println(err)
+		return internalError()
+	}
+	return nil
+}
+
+// Changes a member's role, or removes them from a room
+func (app *Application) roomMemberHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		log.Println(r.Method + " /api/chatroom/" + vars["name"] + "/members/" + vars["user"])
+		userName := app.currentUser(r)
+		roomModel, appErr := app.findChatRoom(userName, vars["name"])
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		if roomModel.Direct {
+			http.Error(w, "Members of direct conversations can't be changed", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case "PATCH":
+			updateRequest := &models.UpdateMemberRequest{}
+			if err := utils.UnmarshalJsonRequest(r, updateRequest); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			appErr = app.setMemberRole(userName, roomModel, vars["user"], updateRequest.Role)
+		case "DELETE":
+			appErr = app.removeMember(userName, roomModel, vars["user"])
+		}
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// Only owners can change roles. Owners can't change their own role, so that every room keeps an owner, but they
+// can make someone else an owner.
+func (app *Application) setMemberRole(changedBy string, roomModel *models.ChatRoom, userName, role string) *appError {
+	if !isValidRole(role) {
+		return newAppError(http.StatusBadRequest, `"role" must be "owner", "moderator" or "member"`)
+	}
+	appErr := app.requireRole(changedBy, roomModel.Id, models.RoleOwner, "Only owners can change roles")
+	if appErr != nil {
+		return appErr
+	}
+	if userName == changedBy {
+		return newAppError(http.StatusBadRequest, "Owners can't change their own role")
+	}
+	if err := app.repository.SetMemberRole(userName, roomModel.Id, role); err != nil {
+		if err == sql.ErrNoRows {
+			return newAppError(http.StatusNotFound, "Could not find a member with that name")
+		}
+		log.Println(err)
+		return internalError()
+	}
+	return nil
+}
+
+// Members can leave a room, except for owners, who have to hand the room over first. Moderators can remove
+// anyone with a lower role than their own.
+func (app *Application) removeMember(removedBy string, roomModel *models.ChatRoom, userName string) *appError {
+	role, err := app.repository.GetMemberRole(userName, roomModel.Id)
+	if err != nil {
+		log.Println(err)
+		return internalError()
+	}
+	if role == "" {
+		return newAppError(http.StatusNotFound, "Could not find a member with that name")
+	}
+	if userName == removedBy {
+		if role == models.RoleOwner {
+			return newAppError(http.StatusBadRequest, "Owners can't leave a room until they make someone else owner")
+		}
+	} else if appErr := app.checkCanModerate(removedBy, userName, roomModel.Id); appErr != nil {
+		return appErr
+	}
+
+	if err := app.repository.RemoveRoomMember(userName, roomModel.Id); err != nil {
+		if err == sql.ErrNoRows {
+			return newAppError(http.StatusNotFound, "Could not find a member with that name")
+		}
+		log.Println(err)
+		return internalError()
+	}
+	// Sessions that are already connected would otherwise keep receiving the room's messages
+	reason := "You were removed from the room"
+	if userName == removedBy {
+		reason = "You left the room"
+	}
+	app.disconnectUser(roomModel.Id, userName, reason)
+	return nil
+}
@@ -0,0 +1,96 @@
+package chat
+
+import (
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/eshyong/chatapp/chat/utils"
+)
+
+// Matches "@username" at the start of the message or after whitespace, so email addresses aren't mentions
+var mentionPattern = regexp.MustCompile(`(?:^|\s)@([\w.-]+)`)
+
+// Returns the unique names mentioned in a message, in the order they appear
+func parseMentions(contents string) []string {
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(contents, -1) {
+		// Allow punctuation right after a name, as in "thanks @alice."
+		name := strings.TrimRight(match[1], ".-")
+		if name != "" && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Saves the users mentioned in a message and sets them on the message. Names that don't belong to a user who can
+// see the room are ignored, so that nobody hears about messages in private rooms they aren't in.
+func (app *Application) saveMentions(roomId int, chatMessage *models.ChatMessage) error {
+	chatMessage.Mentions = nil
+	names := parseMentions(chatMessage.Contents)
+	if len(names) > 0 {
+		userNames, err := app.repository.FindRoomUserNames(roomId, names)
+		if err != nil {
+			return err
+		}
+		if len(userNames) > 0 {
+			chatMessage.Mentions = userNames
+		}
+	}
+	// New messages have no mentions to clear, so most of them don't need saving at all
+	if len(chatMessage.Mentions) == 0 && chatMessage.EditedAt == "" {
+		return nil
+	}
+	return app.repository.SetMentions(chatMessage.Id, chatMessage.Mentions)
+}
+
+// Lets each user mentioned in a new message know about it, wherever they're connected. The mentions must have been
+// saved first, which leaves out anyone who can't see the room.
+func (app *Application) notifyMentions(roomId int, chatMessage *models.ChatMessage) {
+	if len(chatMessage.Mentions) == 0 {
+		return
+	}
+	roomModel, err := app.repository.FindChatRoomById(roomId)
+	if err != nil {
+		log.Println("Unable to send mentions: " + err.Error())
+		return
+	}
+	message := newServerMessage(models.WsTypeMention, &models.Mention{
+		RoomName: roomModel.RoomName,
+		Message:  chatMessage,
+	})
+	for _, userName := range chatMessage.Mentions {
+		if userName != chatMessage.SentBy {
+			app.sendToUser(userName, message)
+		}
+	}
+}
+
+// Lists the most recent messages that mentioned the current user, across all rooms
+func (app *Application) listMentionsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Println("GET /api/mentions")
+		limit := 0
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+				http.Error(w, `"limit" must be a positive number`, http.StatusBadRequest)
+				return
+			}
+		}
+
+		mentionList, err := app.repository.GetMentionsForUser(app.currentUser(r), limit)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, defaultErrorMessage, http.StatusInternalServerError)
+			return
+		}
+		utils.WriteJsonResponse(w, mentionList)
+	})
+}
@@ -0,0 +1,178 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/eshyong/chatapp/chat/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Matches the size of the contents column in chat_message
+	maxMessageLength = 4096
+)
+
+func validateContents(contents string) *appError {
+	if contents == "" {
+		return newAppError(http.StatusBadRequest, "Message cannot be empty")
+	}
+	if len(contents) > maxMessageLength {
+		return newAppError(http.StatusBadRequest, "Message is too long")
+	}
+	return nil
+}
+
+// Finds a message that the user is allowed to change. Only the sender can edit a message, since edits are shown under
+// their name, but moderators can delete any message in the room.
+func (app *Application) findEditableMessage(userName string, roomModel *models.ChatRoom, messageId int, deleting bool) (*models.ChatMessage, *appError) {
+	if appErr := checkNotArchived(roomModel); appErr != nil {
+		return nil, appErr
+	}
+	chatMessage, err := app.repository.FindChatMessage(roomModel.Id, messageId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, newAppError(http.StatusNotFound, "Could not find message with that ID")
+		}
+		log.Println(err)
+		return nil, internalError()
+	}
+	if chatMessage.SentBy != userName {
+		if !deleting {
+			return nil, newAppError(http.StatusForbidden, "You can only edit your own messages")
+		}
+		appErr := app.requireRole(userName, roomModel.Id, models.RoleModerator, "You can only delete your own messages")
+		if appErr != nil {
+			return nil, appErr
+		}
+	}
+	if chatMessage.Deleted {
+		return nil, newAppError(http.StatusBadRequest, "Message has already been deleted")
+	}
+	return chatMessage, nil
+}
+
+func (app *Application) editChatMessage(userName string, roomModel *models.ChatRoom, messageId int, contents string) (*models.ChatMessage, *appError) {
+	if err := validateContents(contents); err != nil {
+		return nil, err
+	}
+	// Edits are broadcast just like new messages, so muted users can't make them either
+	if appErr := app.checkNotMuted(userName, roomModel.Id); appErr != nil {
+		return nil, appErr
+	}
+	chatMessage, appErr := app.findEditableMessage(userName, roomModel, messageId, false)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	undoRate, appErr := app.checkChangeRate(userName)
+	if appErr != nil {
+		return nil, appErr
+	}
+	editedAt := time.Now().UTC().Format(time.RFC3339)
+	if err := app.repository.UpdateChatMessageContents(messageId, contents, editedAt); err != nil {
+		undoRate()
+		log.Println(err)
+		return nil, internalError()
+	}
+	chatMessage.Contents = contents
+	chatMessage.EditedAt = editedAt
+	// Mentions follow the new contents, but only new messages send notifications
+	if err := app.saveMentions(roomModel.Id, chatMessage); err != nil {
+		log.Println("Unable to save mentions: " + err.Error())
+	}
+
+	app.broadcastToRoom(roomModel.Id, newServerMessage(models.WsTypeEdit, chatMessage))
+	return chatMessage, nil
+}
+
+func (app *Application) deleteChatMessage(userName string, roomModel *models.ChatRoom, messageId int) (*models.ChatMessage, *appError) {
+	chatMessage, appErr := app.findEditableMessage(userName, roomModel, messageId, true)
+	if appErr != nil {
+		return nil, appErr
+	}
+
+	if err := app.repository.DeleteChatMessage(messageId, time.Now().UTC().Format(time.RFC3339)); err != nil {
+		log.Println(err)
+		return nil, internalError()
+	}
+	chatMessage.Contents = ""
+	chatMessage.Deleted = true
+
+	app.broadcastToRoom(roomModel.Id, newServerMessage(models.WsTypeDelete, chatMessage))
+	return chatMessage, nil
+}
+
+// Handles PATCH and DELETE requests for a single message
+func (app *Application) chatMessageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		log.Println(r.Method + " /api/chatroom/" + vars["name"] + "/messages/" + vars["id"])
+		userName := app.currentUser(r)
+		messageId, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Message ID must be a number", http.StatusBadRequest)
+			return
+		}
+		roomModel, appErr := app.findChatRoom(userName, vars["name"])
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		// Banned users are disconnected from the room, but public rooms can still be found over HTTP
+		if appErr := app.checkNotBanned(userName, roomModel.Id); appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+
+		var chatMessage *models.ChatMessage
+		switch r.Method {
+		case "PATCH":
+			editRequest := &models.EditChatMessageRequest{}
+			if err := utils.UnmarshalJsonRequest(r, editRequest); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			chatMessage, appErr = app.editChatMessage(userName, roomModel, messageId, editRequest.Contents)
+		case "DELETE":
+			chatMessage, appErr = app.deleteChatMessage(userName, roomModel, messageId)
+		}
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		utils.WriteJsonResponse(w, chatMessage)
+	})
+}
+
+// Handles edit and delete requests sent over the websocket
+func (app *Application) handleChatMessageChange(req *clientRequest, messageType string, body json.RawMessage) {
+	change := &models.ChatMessage{}
+	if err := json.Unmarshal(body, change); err != nil {
+		req.replyError("Unable to parse chat message")
+		return
+	}
+	roomModel, err := app.repository.FindChatRoomById(req.room.roomId)
+	if err != nil {
+		log.Println(err)
+		req.replyError(defaultErrorMessage)
+		return
+	}
+
+	var appErr *appError
+	if messageType == models.WsTypeEdit {
+		_, appErr = app.editChatMessage(req.session.UserName, roomModel, change.Id, change.Contents)
+	} else {
+		_, appErr = app.deleteChatMessage(req.session.UserName, roomModel, change.Id)
+	}
+	if appErr != nil {
+		req.replyAppError(appErr)
+		return
+	}
+	req.reply(newServerMessage(models.WsTypeAck, &models.Ack{MessageId: change.Id}))
+}
@@ -1,5 +1,7 @@
 package models
 
+import "encoding/json"
+
 type LoginRequest struct {
 	UserName string
 	Password string
@@ -13,15 +15,124 @@ type ChatUser struct {
 	Password string
 }
 
+const (
+	// Anyone can see and join public rooms
+	VisibilityPublic = "public"
+	// Only members can see and join private rooms
+	VisibilityPrivate = "private"
+)
+
+const (
+	// Owners can do anything in a room, including renaming and deleting it
+	RoleOwner = "owner"
+	// Moderators manage a room's members and messages
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+)
+
+// The creator is always the current user
 type CreateChatRoomRequest struct {
+	RoomName string `json:"roomName"`
+	// Defaults to public
+	Visibility string `json:"visibility"`
+}
+
+// Changes some of a room's details. Fields that aren't set are left alone.
+type UpdateChatRoomRequest struct {
+	RoomName    *string `json:"roomName"`
+	Topic       *string `json:"topic"`
+	Description *string `json:"description"`
+	Archived    *bool   `json:"archived"`
+}
+
+type AddMemberRequest struct {
+	UserName string `json:"userName"`
+}
+
+type UpdateMemberRequest struct {
+	Role string `json:"role"`
+}
+
+type RoomMember struct {
+	UserName string `json:"userName"`
+	Role     string `json:"role"`
+	Muted    bool   `json:"muted,omitempty"`
+}
+
+// A kick, ban or mute, sent by a moderator
+type ModerationRequest struct {
+	UserName string `json:"userName"`
+	Reason   string `json:"reason,omitempty"`
+	// How long a ban lasts. Zero means it's permanent.
+	DurationSeconds int `json:"durationSeconds,omitempty"`
+}
+
+// Sent to the room when a moderator kicks, bans or mutes someone
+type ModerationEvent struct {
+	UserName    string `json:"userName"`
+	ModeratedBy string `json:"moderatedBy"`
+	Reason      string `json:"reason,omitempty"`
+	// When a ban ends, if it isn't permanent
+	ExpiresAt string `json:"expiresAt,omitempty"`
+}
+
+type Ban struct {
+	UserName  string `json:"userName"`
+	BannedBy  string `json:"bannedBy"`
+	Reason    string `json:"reason,omitempty"`
+	BannedAt  string `json:"bannedAt"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+}
+
+type CreateInviteRequest struct {
+	// How long the invite lasts. Defaults to a day.
+	ExpiresInSeconds int `json:"expiresInSeconds"`
+	// How many times the invite can be used, e.g. 1 for a single-use invite. Zero means there's no limit.
+	MaxUses int `json:"maxUses"`
+}
+
+type Invite struct {
+	Token     string `json:"token"`
 	RoomName  string `json:"roomName"`
 	CreatedBy string `json:"createdBy"`
+	CreatedAt string `json:"createdAt"`
+	ExpiresAt string `json:"expiresAt"`
+	MaxUses   int    `json:"maxUses,omitempty"`
+	Uses      int    `json:"uses"`
 }
 
 type ChatRoom struct {
 	Id        int    `json:"id"`
 	RoomName  string `json:"roomName"`
 	CreatedBy string `json:"createdBy"`
+	// Number of top level messages from other users since the current user last read the room. Only set when
+	// listing rooms.
+	UnreadCount int    `json:"unreadCount"`
+	Visibility  string `json:"visibility"`
+	// Direct conversations are private rooms whose members are chosen when they're created
+	Direct  bool     `json:"direct"`
+	Members []string `json:"members,omitempty"`
+	// The current user's role, if they're a member. Only set when listing rooms.
+	Role string `json:"role,omitempty"`
+	// How long members have to wait between messages. Zero means slow mode is off.
+	SlowModeSeconds int    `json:"slowModeSeconds,omitempty"`
+	Topic           string `json:"topic"`
+	Description     string `json:"description"`
+	CreatedAt       string `json:"createdAt"`
+	// Archived rooms are read only
+	Archived bool `json:"archived"`
+}
+
+// Sets a room's slow mode. Also sent to the room as a "slow_mode" event.
+type SlowMode struct {
+	Seconds int `json:"seconds"`
+	// Filled in by the server
+	SetBy string `json:"setBy,omitempty"`
+}
+
+type CreateDirectRoomRequest struct {
+	// Users to talk to, besides the current user
+	Participants []string `json:"participants"`
 }
 
 type ChatRoomList struct {
@@ -34,17 +145,219 @@ type UserInfo struct {
 }
 
 type ChatMessage struct {
+	Id       int    `json:"id"`
 	SentBy   string `json:"sentBy"`
 	Contents string `json:"contents"`
 	TimeSent string `json:"timeSent"`
+	// Set if the message was edited after it was sent
+	EditedAt string `json:"editedAt,omitempty"`
+	// Deleted messages are kept in the history with their contents removed
+	Deleted bool `json:"deleted,omitempty"`
+	// Emoji reactions, in the order they were first used
+	Reactions []*Reaction `json:"reactions,omitempty"`
+	// If the message is a reply, the ID of the message that started the thread
+	ParentId int `json:"parentId,omitempty"`
+	// Number of replies, if the message started a thread
+	ReplyCount int `json:"replyCount,omitempty"`
+	// Names of the users mentioned in the message with an @
+	Mentions []string `json:"mentions,omitempty"`
+}
+
+// A message that mentioned a user, and the room it was sent to
+type Mention struct {
+	RoomName string       `json:"roomName"`
+	Message  *ChatMessage `json:"message"`
+}
+
+type MentionList struct {
+	Results []*Mention `json:"results"`
+}
+
+type PinRequest struct {
+	MessageId int `json:"messageId"`
+}
+
+// A pinned message. Also sent to the room as a "pin" or "unpin" event, in which case PinnedBy and PinnedAt are who
+// made the change and when.
+type Pin struct {
+	Message  *ChatMessage `json:"message"`
+	PinnedBy string       `json:"pinnedBy"`
+	PinnedAt string       `json:"pinnedAt"`
+}
+
+// Pinned messages in a room, oldest first
+type PinList struct {
+	Pins []*Pin `json:"pins"`
+}
+
+// A page of replies to a message
+type Thread struct {
+	Parent  *ChatMessage `json:"parent"`
+	Replies *HistoryPage `json:"replies"`
+}
+
+// Query for a page of a thread, sent over the websocket
+type ThreadQuery struct {
+	ParentId int `json:"parentId"`
+	HistoryQuery
+}
+
+// Sent to the room when a thread gets a new reply
+type ThreadUpdate struct {
+	ParentId   int `json:"parentId"`
+	ReplyCount int `json:"replyCount"`
+}
+
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	// Names of the users who reacted
+	Users []string `json:"users"`
+}
+
+type ReactionRequest struct {
+	MessageId int    `json:"messageId"`
+	Emoji     string `json:"emoji"`
+}
+
+// The current reactions on a message, sent whenever they change
+type ReactionEvent struct {
+	MessageId int         `json:"messageId"`
+	Reactions []*Reaction `json:"reactions"`
+}
+
+type EditChatMessageRequest struct {
+	Contents string `json:"contents"`
+}
+
+// Cursor based query for a page of chat history, ordered by ID, which is the order messages were saved in. At most
+// one of Before and After should be set. If neither is, the query returns the most recent messages.
+type HistoryQuery struct {
+	// Only return messages older than the message with this ID
+	Before int `json:"before,omitempty"`
+	// Only return messages newer than the message with this ID
+	After int `json:"after,omitempty"`
+	// Maximum number of messages to return
+	Limit int `json:"limit,omitempty"`
+}
+
+type HistoryPage struct {
+	// Messages in the page, oldest first
+	Messages []*ChatMessage `json:"messages"`
+	// True if there are more messages past this page, in the direction of the query
+	HasMore bool `json:"hasMore"`
 }
 
-// Websocket chat protocol struct
+// Version of the websocket protocol. Clients must send it with every message.
+const WsProtocolVersion = 1
+
+// Websocket message types, used by both clients and the server
+const (
+	// A chat message. Body is a ChatMessage.
+	WsTypeMessage = "message"
+	// A page of chat history. Clients send a HistoryQuery, and the server replies with a HistoryPage.
+	WsTypeHistory = "history"
+	// A user joined or left the chat room. Body is a PresenceEvent. Users with several sessions in the room only
+	// join when the first one connects, and leave when the last one disconnects.
+	WsTypeJoin  = "join"
+	WsTypeLeave = "leave"
+	// Everyone in the room, sent after joining. Body is a Presence.
+	WsTypePresence = "presence"
+	// Edit or delete a chat message. Clients send a ChatMessage with the ID (and new contents for edits), and the
+	// server broadcasts the updated ChatMessage.
+	WsTypeEdit   = "edit"
+	WsTypeDelete = "delete"
+	// Add or remove a reaction. Clients send a ReactionRequest, and the server broadcasts a ReactionEvent of type
+	// "reactions" to the room.
+	WsTypeReact     = "react"
+	WsTypeUnreact   = "unreact"
+	WsTypeReactions = "reactions"
+	// Threads. Clients send a ThreadQuery of type "thread" to get a page of replies, which the server answers with
+	// a Thread. Clients subscribe to a thread with a ThreadQuery to get its replies as they're sent (sending a reply
+	// subscribes automatically). Everyone in the room gets a ThreadUpdate when a thread has a new reply.
+	WsTypeThread            = "thread"
+	WsTypeThreadSubscribe   = "thread_subscribe"
+	WsTypeThreadUnsubscribe = "thread_unsubscribe"
+	WsTypeThreadUpdate      = "thread_update"
+	// A user read the room up to a message. Clients send a ReadReceipt with the message ID, and the server
+	// broadcasts it to the room with the user's name filled in.
+	WsTypeRead = "read"
+	// The user was mentioned in a message, possibly in another room. Body is a Mention.
+	WsTypeMention = "mention"
+	// A user started or stopped typing. Body is a TypingEvent. Clients should keep sending typing events every few
+	// seconds while the user types, since the server stops the indicator if it doesn't hear from them.
+	WsTypeTyping = "typing"
+	// Moderation commands. Moderators send a ModerationRequest, and the server broadcasts a ModerationEvent of the
+	// same type to the room. Kicked and banned users are disconnected, and muted users can't send messages until
+	// they're unmuted.
+	WsTypeKick   = "kick"
+	WsTypeBan    = "ban"
+	WsTypeUnban  = "unban"
+	WsTypeMute   = "mute"
+	WsTypeUnmute = "unmute"
+	// A moderator changed the room's slow mode. Body is a SlowMode.
+	WsTypeSlowMode = "slow_mode"
+	// The room's details, sent after joining and whenever they change. Body is a ChatRoom.
+	WsTypeRoomUpdated = "room_updated"
+	// The room was deleted, and everyone in it is about to be disconnected. Body is a ChatRoom.
+	WsTypeRoomDeleted = "room_deleted"
+	// Pin or unpin a message. Moderators send a PinRequest, and the server broadcasts a Pin to the room.
+	WsTypePin   = "pin"
+	WsTypeUnpin = "unpin"
+	// The room's pinned messages, sent after joining. Body is a PinList.
+	WsTypePins = "pins"
+	// The server processed a client message. Body is an Ack.
+	WsTypeAck = "ack"
+	// The server couldn't process a client message. The reason field describes what went wrong.
+	WsTypeError = "error"
+)
+
+// Websocket message sent from a client to the server
+type WsClientMessage struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	// Optional client generated ID, which the server includes in its ack or error reply
+	Nonce string `json:"nonce,omitempty"`
+	// Decoded according to the message type
+	Body json.RawMessage `json:"body"`
+}
+
+// Websocket message sent from the server to a client
 type WsServerMessage struct {
-	// If there was an error in processing a websocket request, this field will be true
-	Error bool `json:"error"`
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	// Set when replying to a client message that had a nonce
+	Nonce string `json:"nonce,omitempty"`
 	// A string describing the reason for an error
-	Reason string `json:"reason"`
-	// A variable length slice containing chat messages to send to the client
-	Body []*ChatMessage `json:"body"`
+	Reason string `json:"reason,omitempty"`
+	// For errors caused by sending messages too quickly, how many milliseconds to wait before sending another
+	RetryAfterMs int64 `json:"retryAfterMs,omitempty"`
+	// Depends on the message type
+	Body interface{} `json:"body,omitempty"`
+}
+
+type ReadReceipt struct {
+	// Filled in by the server
+	UserName  string `json:"userName"`
+	MessageId int    `json:"messageId"`
+}
+
+type TypingEvent struct {
+	// Filled in by the server
+	UserName string `json:"userName"`
+	Typing   bool   `json:"typing"`
+}
+
+type PresenceEvent struct {
+	UserName string `json:"userName"`
+}
+
+type Presence struct {
+	// Names of the users in the room, sorted
+	Users []string `json:"users"`
+}
+
+type Ack struct {
+	// ID of the chat message that was saved, if any
+	MessageId int `json:"messageId,omitempty"`
 }
@@ -0,0 +1,216 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/eshyong/chatapp/chat/utils"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Matches the size of the reason column in chat_ban
+	maxModerationReasonLength = 256
+)
+
+// Checks that a user is allowed to moderate another, i.e. that they're a moderator and outrank them
+func (app *Application) checkCanModerate(moderator, userName string, roomId int) *appError {
+	moderatorRole, err := app.repository.GetMemberRole(moderator, roomId)
+	if err != nil {
+		log.Println(err)
+		return internalError()
+	}
+	if roleRanks[moderatorRole] < roleRanks[models.RoleModerator] {
+		return newAppError(http.StatusForbidden, "Only moderators can do that")
+	}
+	role, err := app.repository.GetMemberRole(userName, roomId)
+	if err != nil {
+		log.Println(err)
+		return internalError()
+	}
+	if roleRanks[moderatorRole] <= roleRanks[role] {
+		return newAppError(http.StatusForbidden, "You can only moderate members with a lower role than yours")
+	}
+	return nil
+}
+
+// Kicks, bans, unbans, mutes or unmutes a user, and lets the room know
+func (app *Application) moderate(moderator string, roomModel *models.ChatRoom, action string, request *models.ModerationRequest) *appError {
+	if request.UserName == "" {
+		return newAppError(http.StatusBadRequest, `"userName" field cannot be empty`)
+	}
+	if request.UserName == moderator {
+		return newAppError(http.StatusBadRequest, "You can't moderate yourself")
+	}
+	if roomModel.Direct {
+		return newAppError(http.StatusBadRequest, "Direct conversations can't be moderated")
+	}
+	if len(request.Reason) > maxModerationReasonLength {
+		return newAppError(http.StatusBadRequest, "Reason is too long")
+	}
+	if request.DurationSeconds < 0 {
+		return newAppError(http.StatusBadRequest, `"durationSeconds" must be a positive number`)
+	}
+	if appErr := app.checkCanModerate(moderator, request.UserName, roomModel.Id); appErr != nil {
+		return appErr
+	}
+
+	event := &models.ModerationEvent{
+		UserName:    request.UserName,
+		ModeratedBy: moderator,
+		Reason:      request.Reason,
+	}
+	var err error
+	switch action {
+	case models.WsTypeKick:
+		// Kicked users can come straight back, unless the room is private and they aren't a member
+	case models.WsTypeBan:
+		if _, err := app.repository.FindUserByName(request.UserName); err != nil {
+			if err == sql.ErrNoRows {
+				return newAppError(http.StatusNotFound, "Could not find user with that name")
+			}
+			log.Println(err)
+			return internalError()
+		}
+		var expiresAt *time.Time
+		if request.DurationSeconds > 0 {
+			expiry := time.Now().Add(time.Duration(request.DurationSeconds) * time.Second).UTC()
+			expiresAt = &expiry
+			event.ExpiresAt = expiry.Format(time.RFC3339)
+		}
+		err = app.repository.BanUser(roomModel.Id, request.UserName, moderator, request.Reason, expiresAt)
+	case models.WsTypeUnban:
+		err = app.repository.UnbanUser(roomModel.Id, request.UserName)
+	case models.WsTypeMute:
+		err = app.repository.MuteUser(roomModel.Id, request.UserName, moderator)
+	case models.WsTypeUnmute:
+		err = app.repository.UnmuteUser(roomModel.Id, request.UserName)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return newAppError(http.StatusNotFound, "Could not find a member or ban for that user")
+		}
+		log.Println(err)
+		return internalError()
+	}
+
+	// Everyone else hears about it before the user is disconnected, so they all see the same thing
+	app.broadcastToRoom(roomModel.Id, newServerMessage(action, event))
+	switch action {
+	case models.WsTypeKick:
+		app.disconnectUser(roomModel.Id, request.UserName, "You were kicked from the room")
+	case models.WsTypeBan:
+		app.disconnectUser(roomModel.Id, request.UserName, "You were banned from the room")
+	}
+	return nil
+}
+
+// Closes every session a user has in a room
+func (app *Application) disconnectUser(roomId int, userName, reason string) {
+	if chatRoom, ok := app.activeChatRoom(roomId); ok {
+		chatRoom.kick(userName, websocket.ClosePolicyViolation, reason)
+	}
+}
+
+// Checks that a user is allowed to join a room
+func (app *Application) checkNotBanned(userName string, roomId int) *appError {
+	banned, err := app.repository.IsBanned(userName, roomId)
+	if err != nil {
+		log.Println(err)
+		return internalError()
+	}
+	if banned {
+		return newAppError(http.StatusForbidden, "You are banned from this room")
+	}
+	return nil
+}
+
+// Checks that a user is allowed to send messages to a room
+func (app *Application) checkNotMuted(userName string, roomId int) *appError {
+	muted, err := app.repository.IsMuted(userName, roomId)
+	if err != nil {
+		log.Println(err)
+		return internalError()
+	}
+	if muted {
+		return newAppError(http.StatusForbidden, "You have been muted in this room")
+	}
+	return nil
+}
+
+// Handles moderation routes that act on the user in the URL. actions maps each HTTP method to a moderation action.
+func (app *Application) moderationHandler(actions map[string]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		log.Println(r.Method + " " + r.URL.Path)
+		userName := app.currentUser(r)
+		roomModel, appErr := app.findChatRoom(userName, vars["name"])
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+
+		request := &models.ModerationRequest{}
+		if r.ContentLength != 0 {
+			if err := utils.UnmarshalJsonRequest(r, request); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		request.UserName = vars["user"]
+		if appErr := app.moderate(userName, roomModel, actions[r.Method], request); appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+func (app *Application) listBansHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomName := mux.Vars(r)["name"]
+		log.Println("GET /api/chatroom/" + roomName + "/bans")
+		userName := app.currentUser(r)
+		roomModel, appErr := app.findChatRoom(userName, roomName)
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		if appErr := app.requireRole(userName, roomModel.Id, models.RoleModerator, "Only moderators can see bans"); appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		bans, err := app.repository.GetBans(roomModel.Id)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, defaultErrorMessage, http.StatusInternalServerError)
+			return
+		}
+		utils.WriteJsonResponse(w, bans)
+	})
+}
+
+// Handles moderation commands sent over the websocket
+func (app *Application) handleModerationRequest(req *clientRequest, action string, body json.RawMessage) {
+	request := &models.ModerationRequest{}
+	if err := json.Unmarshal(body, request); err != nil {
+		req.replyError("Unable to parse moderation request")
+		return
+	}
+	roomModel, err := app.repository.FindChatRoomById(req.room.roomId)
+	if err != nil {
+		log.Println(err)
+		req.replyError(defaultErrorMessage)
+		return
+	}
+	if appErr := app.moderate(req.session.UserName, roomModel, action, request); appErr != nil {
+		req.replyError(appErr.Message)
+		return
+	}
+	req.reply(newServerMessage(models.WsTypeAck, &models.Ack{}))
+}
@@ -0,0 +1,151 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/eshyong/chatapp/chat/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Most messages that can be pinned in a room at once
+	maxPinsPerRoom = 50
+)
+
+// Pins or unpins a message, and lets the room know. Pinning a message that's already pinned returns the existing pin.
+func (app *Application) setPin(userName string, roomModel *models.ChatRoom, messageId int, pin bool) (*models.Pin, *appError) {
+	appErr := app.requireRole(userName, roomModel.Id, models.RoleModerator, "Only moderators can pin messages")
+	if appErr != nil {
+		return nil, appErr
+	}
+	if appErr := checkNotArchived(roomModel); appErr != nil {
+		return nil, appErr
+	}
+	chatMessage, err := app.repository.FindChatMessage(roomModel.Id, messageId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, newAppError(http.StatusNotFound, "Could not find message with that ID")
+		}
+		log.Println(err)
+		return nil, internalError()
+	}
+
+	event := &models.Pin{
+		Message:  chatMessage,
+		PinnedBy: userName,
+	}
+	messageType := models.WsTypeUnpin
+	if pin {
+		if chatMessage.Deleted {
+			return nil, newAppError(http.StatusBadRequest, "Can't pin a deleted message")
+		}
+		pins, err := app.repository.GetPins(roomModel.Id)
+		if err != nil {
+			log.Println(err)
+			return nil, internalError()
+		}
+		for _, existing := range pins.Pins {
+			if existing.Message.Id == messageId {
+				// Already pinned, which leaves nothing to change even if the room is full
+				return existing, nil
+			}
+		}
+		if len(pins.Pins) >= maxPinsPerRoom {
+			return nil, newAppError(http.StatusBadRequest, "Too many pinned messages. Unpin one first")
+		}
+		added, err := app.repository.PinMessage(roomModel.Id, event)
+		if err != nil {
+			log.Println(err)
+			return nil, internalError()
+		}
+		if !added {
+			// Nothing changed, so there's nothing to tell the room
+			return event, nil
+		}
+		messageType = models.WsTypePin
+	} else {
+		event.PinnedAt = time.Now().UTC().Format(time.RFC3339)
+		err = app.repository.UnpinMessage(roomModel.Id, messageId)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, newAppError(http.StatusNotFound, "That message isn't pinned")
+		}
+		log.Println(err)
+		return nil, internalError()
+	}
+
+	app.broadcastToRoom(roomModel.Id, newServerMessage(messageType, event))
+	return event, nil
+}
+
+func (app *Application) listPinsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomName := mux.Vars(r)["name"]
+		log.Println("GET /api/chatroom/" + roomName + "/pins")
+		roomModel, appErr := app.findChatRoom(app.currentUser(r), roomName)
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		pins, err := app.repository.GetPins(roomModel.Id)
+		if err != nil {
+			log.Println(err)
+			http.Error(w, defaultErrorMessage, http.StatusInternalServerError)
+			return
+		}
+		utils.WriteJsonResponse(w, pins)
+	})
+}
+
+func (app *Application) pinHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		log.Println(r.Method + " /api/chatroom/" + vars["name"] + "/pins/" + vars["id"])
+		userName := app.currentUser(r)
+		messageId, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Message ID must be a number", http.StatusBadRequest)
+			return
+		}
+		roomModel, appErr := app.findChatRoom(userName, vars["name"])
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+
+		pin, appErr := app.setPin(userName, roomModel, messageId, r.Method == "PUT")
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		utils.WriteJsonResponse(w, pin)
+	})
+}
+
+// Handles pin and unpin requests sent over the websocket
+func (app *Application) handlePinRequest(req *clientRequest, messageType string, body json.RawMessage) {
+	pinRequest := &models.PinRequest{}
+	if err := json.Unmarshal(body, pinRequest); err != nil {
+		req.replyError("Unable to parse pin request")
+		return
+	}
+	roomModel, err := app.repository.FindChatRoomById(req.room.roomId)
+	if err != nil {
+		log.Println(err)
+		req.replyError(defaultErrorMessage)
+		return
+	}
+	_, appErr := app.setPin(req.session.UserName, roomModel, pinRequest.MessageId, messageType == models.WsTypePin)
+	if appErr != nil {
+		req.replyError(appErr.Message)
+		return
+	}
+	req.reply(newServerMessage(models.WsTypeAck, &models.Ack{MessageId: pinRequest.MessageId}))
+}
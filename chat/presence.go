@@ -0,0 +1,33 @@
+package chat
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/eshyong/chatapp/chat/utils"
+	"github.com/gorilla/mux"
+)
+
+// Returns the names of everyone connected to a room
+func (app *Application) onlineUsers(roomId int) []string {
+	if chatRoom, ok := app.activeChatRoom(roomId); ok {
+		if users := chatRoom.roster(); users != nil {
+			return users
+		}
+	}
+	return []string{}
+}
+
+func (app *Application) onlineMembersHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomName := mux.Vars(r)["name"]
+		log.Println("GET /api/chatroom/" + roomName + "/members/online")
+		roomModel, appErr := app.findChatRoom(app.currentUser(r), roomName)
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		utils.WriteJsonResponse(w, &models.Presence{Users: app.onlineUsers(roomModel.Id)})
+	})
+}
@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/eshyong/chatapp/chat/models"
+)
+
+func newServerMessage(messageType string, body interface{}) *models.WsServerMessage {
+	return &models.WsServerMessage{
+		Version: models.WsProtocolVersion,
+		Type:    messageType,
+		Body:    body,
+	}
+}
+
+func newErrorMessage(reason string) *models.WsServerMessage {
+	return &models.WsServerMessage{
+		Version: models.WsProtocolVersion,
+		Type:    models.WsTypeError,
+		Reason:  reason,
+	}
+}
+
+// A message from a client, along with the session and room it came from
+type clientRequest struct {
+	session *ChatSession
+	room    *ChatRoom
+	nonce   string
+}
+
+// Sends a message back to the client that made the request, tagged with the request's nonce
+func (req *clientRequest) reply(message *models.WsServerMessage) {
+	message.Nonce = req.nonce
+	req.room.sendTo(req.session, message)
+}
+
+func (req *clientRequest) replyError(reason string) {
+	req.reply(newErrorMessage(reason))
+}
+
+// Replies with an error, including when to try again if the client is sending too quickly
+func (req *clientRequest) replyAppError(appErr *appError) {
+	message := newErrorMessage(appErr.Message)
+	message.RetryAfterMs = int64(appErr.RetryAfter / time.Millisecond)
+	req.reply(message)
+}
+
+// Decodes a raw message from a client and dispatches it on its type
+func (app *Application) handleClientMessage(chatSession *ChatSession, chatRoom *ChatRoom, data []byte) {
+	req := &clientRequest{
+		session: chatSession,
+		room:    chatRoom,
+	}
+	clientMessage := &models.WsClientMessage{}
+	if err := json.Unmarshal(data, clientMessage); err != nil {
+		req.replyError("Unable to parse message")
+		return
+	}
+	req.nonce = clientMessage.Nonce
+	if clientMessage.Version != models.WsProtocolVersion {
+		req.replyError("Unsupported protocol version")
+		return
+	}
+
+	switch clientMessage.Type {
+	case models.WsTypeMessage:
+		chatMessage := &models.ChatMessage{}
+		if err := json.Unmarshal(clientMessage.Body, chatMessage); err != nil {
+			req.replyError("Unable to parse chat message")
+			return
+		}
+		app.handleChatMessage(req, chatMessage)
+	case models.WsTypeHistory:
+		query := &models.HistoryQuery{}
+		if err := json.Unmarshal(clientMessage.Body, query); err != nil {
+			req.replyError("Unable to parse history query")
+			return
+		}
+		app.handleHistoryRequest(req, query)
+	case models.WsTypeEdit, models.WsTypeDelete:
+		app.handleChatMessageChange(req, clientMessage.Type, clientMessage.Body)
+	case models.WsTypeReact, models.WsTypeUnreact:
+		app.handleReactionRequest(req, clientMessage.Type, clientMessage.Body)
+	case models.WsTypeThread, models.WsTypeThreadSubscribe, models.WsTypeThreadUnsubscribe:
+		app.handleThreadRequest(req, clientMessage.Type, clientMessage.Body)
+	case models.WsTypeRead:
+		app.handleReadReceipt(req, clientMessage.Body)
+	case models.WsTypeKick, models.WsTypeBan, models.WsTypeUnban, models.WsTypeMute, models.WsTypeUnmute:
+		app.handleModerationRequest(req, clientMessage.Type, clientMessage.Body)
+	case models.WsTypePin, models.WsTypeUnpin:
+		app.handlePinRequest(req, clientMessage.Type, clientMessage.Body)
+	case models.WsTypeTyping:
+		// Typing indicators aren't saved or acknowledged, since they're only useful for a few seconds
+		typingEvent := &models.TypingEvent{}
+		if err := json.Unmarshal(clientMessage.Body, typingEvent); err != nil {
+			req.replyError("Unable to parse typing event")
+			return
+		}
+		req.room.updateTyping(req.session, typingEvent.Typing)
+	default:
+		req.replyError("Unsupported message type: " + clientMessage.Type)
+	}
+}
+
+func (app *Application) handleChatMessage(req *clientRequest, chatMessage *models.ChatMessage) {
+	// The sender and timestamp come from the server, so that users can't impersonate each other or backdate
+	// messages
+	if chatMessage.SentBy != "" && chatMessage.SentBy != req.session.UserName {
+		req.replyError("You can only send messages as yourself")
+		return
+	}
+	if err := validateContents(chatMessage.Contents); err != nil {
+		req.replyError(err.Message)
+		return
+	}
+	roomModel, err := app.repository.FindChatRoomById(req.room.roomId)
+	if err != nil {
+		log.Println(err)
+		req.replyError(defaultErrorMessage)
+		return
+	}
+	if appErr := checkNotArchived(roomModel); appErr != nil {
+		req.replyError(appErr.Message)
+		return
+	}
+	if appErr := app.checkNotMuted(req.session.UserName, req.room.roomId); appErr != nil {
+		req.replyError(appErr.Message)
+		return
+	}
+	if chatMessage.ParentId != 0 {
+		parent, appErr := app.findThreadParent(req.room.roomId, chatMessage.ParentId)
+		if appErr != nil {
+			req.replyError(appErr.Message)
+			return
+		}
+		if parent.Deleted {
+			req.replyError("Can't reply to a deleted message")
+			return
+		}
+	}
+	// Checked last, so that messages rejected for anything else don't count towards the rate limit
+	undoRate, appErr := app.checkMessageRate(req.session.UserName, roomModel)
+	if appErr != nil {
+		req.replyAppError(appErr)
+		return
+	}
+	chatMessage.SentBy = req.session.UserName
+	chatMessage.TimeSent = time.Now().UTC().Format(time.RFC3339)
+	// These are filled in by the server
+	chatMessage.EditedAt = ""
+	chatMessage.Deleted = false
+	chatMessage.Reactions = nil
+	chatMessage.ReplyCount = 0
+	chatMessage.Mentions = nil
+
+	id, err := app.repository.InsertChatMessage(req.room.roomId, chatMessage)
+	if err != nil {
+		undoRate()
+		log.Println("Unable to insert chat message: " + err.Error())
+		req.replyError("Unable to send message")
+		return
+	}
+	chatMessage.Id = id
+	if err := app.saveMentions(req.room.roomId, chatMessage); err != nil {
+		// The message itself was saved, so carry on without the mentions
+		log.Println("Unable to save mentions: " + err.Error())
+	}
+	defer app.notifyMentions(req.room.roomId, chatMessage)
+
+	req.reply(newServerMessage(models.WsTypeAck, &models.Ack{MessageId: id}))
+	// Sending a message means the user is done typing it
+	req.room.updateTyping(req.session, false)
+	if chatMessage.ParentId != 0 {
+		app.broadcastReply(req, chatMessage)
+		return
+	}
+	// Everyone gets the message, including the sender, who receives the canonical version
+	req.room.send(&roomBroadcast{
+		message: newServerMessage(models.WsTypeMessage, chatMessage),
+	})
+}
@@ -0,0 +1,269 @@
+package chat
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/eshyong/chatapp/chat/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Longest slow mode a room can have
+	maxSlowModeSeconds = 6 * 60 * 60
+	// How often the rate limiter forgets users who haven't sent anything in a while
+	rateLimiterSweepInterval = time.Minute
+)
+
+// Limits how fast each user can send messages, across all of their sessions. Every user has a bucket of tokens,
+// and every message takes one. Tokens come back one per interval, up to the burst size, so users can send a few
+// messages in quick succession but not keep it up.
+type rateLimiter struct {
+	interval time.Duration
+	burst    int
+
+	mutex     sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// An interval of zero turns rate limiting off
+func newRateLimiter(interval time.Duration, burst int) *rateLimiter {
+	return &rateLimiter{
+		interval:  interval,
+		burst:     burst,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Takes a token for the user if they have one. If not, returns how long until they will.
+func (limiter *rateLimiter) take(userName string, now time.Time) (bool, time.Duration) {
+	if limiter.interval == 0 {
+		return true, 0
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.sweep(now)
+
+	bucket, ok := limiter.buckets[userName]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(limiter.burst), updated: now}
+		limiter.buckets[userName] = bucket
+	}
+	bucket.tokens += float64(now.Sub(bucket.updated)) / float64(limiter.interval)
+	if bucket.tokens > float64(limiter.burst) {
+		bucket.tokens = float64(limiter.burst)
+	}
+	bucket.updated = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) * float64(limiter.interval))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// Gives back a token taken for something that ended up not happening, e.g. a message that couldn't be saved
+func (limiter *rateLimiter) refund(userName string) {
+	if limiter.interval == 0 {
+		return
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	if bucket, ok := limiter.buckets[userName]; ok {
+		bucket.tokens = math.Min(bucket.tokens+1, float64(limiter.burst))
+	}
+}
+
+// Forgets buckets that have filled back up, since they're no different from new ones
+func (limiter *rateLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	limiter.lastSweep = now
+	refillTime := limiter.interval * time.Duration(limiter.burst)
+	for userName, bucket := range limiter.buckets {
+		if now.Sub(bucket.updated) >= refillTime {
+			delete(limiter.buckets, userName)
+		}
+	}
+}
+
+// Remembers when users last sent a message to rooms in slow mode. The last message in the database alone isn't
+// enough, since a user sending from several sessions at once could get more than one message through before the
+// first is saved.
+type slowModeLimiter struct {
+	mutex     sync.Mutex
+	lastSent  map[slowModeKey]time.Time
+	lastSweep time.Time
+}
+
+type slowModeKey struct {
+	roomId   int
+	userName string
+}
+
+func newSlowModeLimiter() *slowModeLimiter {
+	return &slowModeLimiter{
+		lastSent:  make(map[slowModeKey]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// Lets the user send a message if they haven't sent one in the last interval, given the last one saved in the
+// database. If they can, they're recorded as sending one now, and the returned function undoes that for a message
+// that ends up not being sent. If they can't, returns how long until they can.
+func (limiter *slowModeLimiter) take(roomId int, userName string, lastSaved time.Time, interval time.Duration, now time.Time) (func(), time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.sweep(now)
+
+	key := slowModeKey{roomId: roomId, userName: userName}
+	previous, ok := limiter.lastSent[key]
+	lastSent := lastSaved
+	if ok && previous.After(lastSent) {
+		lastSent = previous
+	}
+	nextAllowed := lastSent.Add(interval)
+	if now.Before(nextAllowed) {
+		return nil, nextAllowed.Sub(now)
+	}
+
+	limiter.lastSent[key] = now
+	undo := func() {
+		limiter.mutex.Lock()
+		defer limiter.mutex.Unlock()
+		// Leave it alone if another message has been let through since
+		if !limiter.lastSent[key].Equal(now) {
+			return
+		}
+		if ok {
+			limiter.lastSent[key] = previous
+		} else {
+			delete(limiter.lastSent, key)
+		}
+	}
+	return undo, 0
+}
+
+// Forgets messages sent longer ago than the longest slow mode, since they can't hold anyone up
+func (limiter *slowModeLimiter) sweep(now time.Time) {
+	if now.Sub(limiter.lastSweep) < rateLimiterSweepInterval {
+		return
+	}
+	limiter.lastSweep = now
+	for key, lastSent := range limiter.lastSent {
+		if now.Sub(lastSent) >= maxSlowModeSeconds*time.Second {
+			delete(limiter.lastSent, key)
+		}
+	}
+}
+
+func newRetryLaterError(retryAfter time.Duration) *appError {
+	// Round up, so that clients that wait exactly this long aren't turned away again
+	seconds := int((retryAfter + time.Second - 1) / time.Second)
+	wait := strconv.Itoa(seconds) + " seconds"
+	if seconds == 1 {
+		wait = "1 second"
+	}
+	appErr := newAppError(http.StatusTooManyRequests, "You're sending messages too quickly. Try again in "+wait)
+	appErr.RetryAfter = retryAfter
+	return appErr
+}
+
+// Checks that a user isn't sending messages faster than the room's slow mode or the rate limit allows, and
+// counts the message against both. It should be the last check before a message is saved, so that messages
+// rejected for other reasons don't count, and the returned function should be called if saving it fails.
+// Moderators aren't affected by slow mode.
+func (app *Application) checkMessageRate(userName string, roomModel *models.ChatRoom) (func(), *appError) {
+	now := time.Now()
+	undoSlowMode := func() {}
+	if roomModel.SlowModeSeconds > 0 {
+		isModerator, appErr := app.hasRole(userName, roomModel.Id, models.RoleModerator)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if !isModerator {
+			lastSaved, err := app.repository.GetLastMessageTime(userName, roomModel.Id)
+			if err != nil {
+				log.Println(err)
+				return nil, internalError()
+			}
+			interval := time.Duration(roomModel.SlowModeSeconds) * time.Second
+			undo, retryAfter := app.slowModeLimiter.take(roomModel.Id, userName, lastSaved, interval, now)
+			if undo == nil {
+				return nil, newRetryLaterError(retryAfter)
+			}
+			undoSlowMode = undo
+		}
+	}
+
+	if ok, retryAfter := app.messageLimiter.take(userName, now); !ok {
+		undoSlowMode()
+		return nil, newRetryLaterError(retryAfter)
+	}
+	return func() {
+		undoSlowMode()
+		app.messageLimiter.refund(userName)
+	}, nil
+}
+
+// Counts an edit or reaction against the same rate limit as messages, since the room sees each of them as they
+// happen. Like checkMessageRate, it should be the last check, and the returned function undoes it.
+func (app *Application) checkChangeRate(userName string) (func(), *appError) {
+	if ok, retryAfter := app.messageLimiter.take(userName, time.Now()); !ok {
+		return nil, newRetryLaterError(retryAfter)
+	}
+	return func() {
+		app.messageLimiter.refund(userName)
+	}, nil
+}
+
+// Lets moderators turn slow mode on and off
+func (app *Application) slowModeHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		roomName := mux.Vars(r)["name"]
+		log.Println("PUT /api/chatroom/" + roomName + "/slowmode")
+		userName := app.currentUser(r)
+		slowMode := &models.SlowMode{}
+		if err := utils.UnmarshalJsonRequest(r, slowMode); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if slowMode.Seconds < 0 || slowMode.Seconds > maxSlowModeSeconds {
+			http.Error(w, `"seconds" must be between 0 and `+strconv.Itoa(maxSlowModeSeconds), http.StatusBadRequest)
+			return
+		}
+
+		roomModel, appErr := app.findChatRoom(userName, roomName)
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		appErr = app.requireRole(userName, roomModel.Id, models.RoleModerator, "Only moderators can change slow mode")
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		if err := app.repository.SetSlowMode(roomModel.Id, slowMode.Seconds); err != nil {
+			log.Println(err)
+			http.Error(w, defaultErrorMessage, http.StatusInternalServerError)
+			return
+		}
+
+		slowMode.SetBy = userName
+		app.broadcastToRoom(roomModel.Id, newServerMessage(models.WsTypeSlowMode, slowMode))
+		utils.WriteJsonResponse(w, slowMode)
+	})
+}
@@ -0,0 +1,126 @@
+package chat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllowsBurst(t *testing.T) {
+	limiter := newRateLimiter(time.Second, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.take("alice", now); !ok {
+			t.Fatalf("message %d of the burst was rejected", i+1)
+		}
+	}
+	if ok, _ := limiter.take("alice", now); ok {
+		t.Fatal("message after the burst was allowed")
+	}
+	// Other users have their own buckets
+	if ok, _ := limiter.take("bob", now); !ok {
+		t.Fatal("another user's message was rejected")
+	}
+}
+
+func TestRateLimiterRefills(t *testing.T) {
+	limiter := newRateLimiter(time.Second, 2)
+	now := time.Now()
+	limiter.take("alice", now)
+	limiter.take("alice", now)
+
+	// One token comes back per interval
+	now = now.Add(time.Second)
+	if ok, _ := limiter.take("alice", now); !ok {
+		t.Fatal("message after one interval was rejected")
+	}
+	if ok, _ := limiter.take("alice", now); ok {
+		t.Fatal("second message after one interval was allowed")
+	}
+
+	// But never more than the burst
+	now = now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if ok, _ := limiter.take("alice", now); !ok {
+			t.Fatalf("message %d after refilling was rejected", i+1)
+		}
+	}
+	if ok, _ := limiter.take("alice", now); ok {
+		t.Fatal("bucket refilled past the burst")
+	}
+}
+
+func TestRateLimiterRetryAfter(t *testing.T) {
+	limiter := newRateLimiter(time.Second, 1)
+	now := time.Now()
+	limiter.take("alice", now)
+
+	ok, retryAfter := limiter.take("alice", now.Add(300*time.Millisecond))
+	if ok {
+		t.Fatal("message before the next token was allowed")
+	}
+	if retryAfter != 700*time.Millisecond {
+		t.Fatalf("expected to retry after 700ms, got %v", retryAfter)
+	}
+	if ok, _ := limiter.take("alice", now.Add(time.Second)); !ok {
+		t.Fatal("message after waiting was rejected")
+	}
+}
+
+func TestRateLimiterRefund(t *testing.T) {
+	limiter := newRateLimiter(time.Second, 1)
+	now := time.Now()
+	limiter.take("alice", now)
+	limiter.refund("alice")
+	if ok, _ := limiter.take("alice", now); !ok {
+		t.Fatal("message after a refund was rejected")
+	}
+
+	// Refunds can't fill the bucket past the burst
+	limiter.refund("alice")
+	limiter.refund("alice")
+	limiter.take("alice", now)
+	if ok, _ := limiter.take("alice", now); ok {
+		t.Fatal("bucket refilled past the burst")
+	}
+}
+
+func TestRateLimiterDisabled(t *testing.T) {
+	limiter := newRateLimiter(0, 1)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		if ok, _ := limiter.take("alice", now); !ok {
+			t.Fatal("message was rejected with rate limiting off")
+		}
+	}
+}
+
+func TestSlowModeLimiterStopsConcurrentMessages(t *testing.T) {
+	limiter := newSlowModeLimiter()
+	now := time.Now()
+	// Neither message has been saved yet, so both see the same last message in the database
+	lastSaved := now.Add(-time.Hour)
+	if undo, _ := limiter.take(1, "alice", lastSaved, time.Minute, now); undo == nil {
+		t.Fatal("first message was rejected")
+	}
+	undo, retryAfter := limiter.take(1, "alice", lastSaved, time.Minute, now.Add(time.Second))
+	if undo != nil {
+		t.Fatal("second message was allowed")
+	}
+	if retryAfter != 59*time.Second {
+		t.Fatalf("expected to retry after 59s, got %v", retryAfter)
+	}
+	// Slow mode is per room
+	if undo, _ := limiter.take(2, "alice", lastSaved, time.Minute, now); undo == nil {
+		t.Fatal("message to another room was rejected")
+	}
+}
+
+func TestSlowModeLimiterUndo(t *testing.T) {
+	limiter := newSlowModeLimiter()
+	now := time.Now()
+	undo, _ := limiter.take(1, "alice", time.Time{}, time.Minute, now)
+	undo()
+	if undo, _ := limiter.take(1, "alice", time.Time{}, time.Minute, now); undo == nil {
+		t.Fatal("message was rejected after undoing the last one")
+	}
+}
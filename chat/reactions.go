@@ -0,0 +1,118 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/eshyong/chatapp/chat/utils"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Matches the size of the emoji column in chat_reaction
+	maxEmojiLength = 32
+)
+
+// Adds or removes a user's reaction on a message, and broadcasts the message's new reactions to the room
+func (app *Application) setReaction(userName string, roomId, messageId int, emoji string, add bool) (*models.ReactionEvent, *appError) {
+	if emoji == "" || len(emoji) > maxEmojiLength || strings.ContainsAny(emoji, " \t\n") {
+		return nil, newAppError(http.StatusBadRequest, "Invalid emoji")
+	}
+	if appErr := app.checkRoomWritable(roomId); appErr != nil {
+		return nil, appErr
+	}
+	chatMessage, err := app.repository.FindChatMessage(roomId, messageId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, newAppError(http.StatusNotFound, "Could not find message with that ID")
+		}
+		log.Println(err)
+		return nil, internalError()
+	}
+	if chatMessage.Deleted {
+		return nil, newAppError(http.StatusBadRequest, "Message has been deleted")
+	}
+
+	undoRate, appErr := app.checkChangeRate(userName)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if add {
+		err = app.repository.AddReaction(messageId, userName, emoji)
+	} else {
+		err = app.repository.RemoveReaction(messageId, userName, emoji)
+	}
+	if err != nil {
+		undoRate()
+		log.Println(err)
+		return nil, internalError()
+	}
+
+	reactions, err := app.repository.GetReactionsByMessageIds([]int64{int64(messageId)})
+	if err != nil {
+		log.Println(err)
+		return nil, internalError()
+	}
+	event := &models.ReactionEvent{
+		MessageId: messageId,
+		Reactions: reactions[messageId],
+	}
+	if event.Reactions == nil {
+		event.Reactions = []*models.Reaction{}
+	}
+	app.broadcastToRoom(roomId, newServerMessage(models.WsTypeReactions, event))
+	return event, nil
+}
+
+// Handles PUT and DELETE requests for a user's reaction on a message
+func (app *Application) reactionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		log.Println(r.Method + " /api/chatroom/" + vars["name"] + "/messages/" + vars["id"] + "/reactions")
+		userName := app.currentUser(r)
+		messageId, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Message ID must be a number", http.StatusBadRequest)
+			return
+		}
+		roomModel, appErr := app.findChatRoom(userName, vars["name"])
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		if appErr := app.checkNotBanned(userName, roomModel.Id); appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+
+		event, appErr := app.setReaction(userName, roomModel.Id, messageId, vars["emoji"], r.Method == "PUT")
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		utils.WriteJsonResponse(w, event)
+	})
+}
+
+// Handles react and unreact requests sent over the websocket
+func (app *Application) handleReactionRequest(req *clientRequest, messageType string, body json.RawMessage) {
+	reactionRequest := &models.ReactionRequest{}
+	if err := json.Unmarshal(body, reactionRequest); err != nil {
+		req.replyError("Unable to parse reaction")
+		return
+	}
+	_, appErr := app.setReaction(
+		req.session.UserName, req.room.roomId, reactionRequest.MessageId, reactionRequest.Emoji,
+		messageType == models.WsTypeReact,
+	)
+	if appErr != nil {
+		req.replyAppError(appErr)
+		return
+	}
+	req.reply(newServerMessage(models.WsTypeAck, &models.Ack{MessageId: reactionRequest.MessageId}))
+}
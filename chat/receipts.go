@@ -0,0 +1,43 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+
+	"github.com/eshyong/chatapp/chat/models"
+)
+
+// Saves how far the user has read in the room, and lets everyone else in the room know
+func (app *Application) handleReadReceipt(req *clientRequest, body json.RawMessage) {
+	receipt := &models.ReadReceipt{}
+	if err := json.Unmarshal(body, receipt); err != nil {
+		req.replyError("Unable to parse read receipt")
+		return
+	}
+	if _, err := app.repository.FindChatMessage(req.room.roomId, receipt.MessageId); err != nil {
+		if err == sql.ErrNoRows {
+			req.replyError("Could not find message with that ID")
+			return
+		}
+		log.Println(err)
+		req.replyError(defaultErrorMessage)
+		return
+	}
+
+	if err := app.repository.UpdateReadPosition(req.session.UserName, req.room.roomId, receipt.MessageId); err != nil {
+		if err == sql.ErrNoRows {
+			req.replyError("You aren't a member of this room")
+			return
+		}
+		log.Println(err)
+		req.replyError(defaultErrorMessage)
+		return
+	}
+	receipt.UserName = req.session.UserName
+	req.reply(newServerMessage(models.WsTypeAck, &models.Ack{MessageId: receipt.MessageId}))
+	req.room.send(&roomBroadcast{
+		exclude: req.session,
+		message: newServerMessage(models.WsTypeRead, receipt),
+	})
+}
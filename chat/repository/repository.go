@@ -3,8 +3,33 @@ package repository
 import (
 	"database/sql"
 	"errors"
+	"time"
 
 	"github.com/eshyong/chatapp/chat/models"
+	"github.com/lib/pq"
+)
+
+const (
+	// Number of chat messages in a page of history, if the caller doesn't ask for a specific number
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+
+	chatRoomColumns = "chat_room.id, room_name, created_by, visibility, is_direct, slow_mode_seconds, topic, " +
+		"description, chat_room.created_at, archived "
+	selectChatRooms = "SELECT " + chatRoomColumns + "FROM chat_room "
+
+	selectChatMessages = "SELECT id, time_sent, sent_by, contents, edited_at, deleted_at, parent_id, " +
+		"(SELECT count(*) FROM chat_message AS reply WHERE reply.parent_id = chat_message.id) " +
+		"FROM chat_message "
+
+	selectIsBanned = "SELECT EXISTS (SELECT 1 FROM chat_ban WHERE user_name = $1 AND chat_room_id = $2 " +
+		"AND (expires_at IS NULL OR expires_at > (now() AT TIME ZONE 'utc')))"
+)
+
+var (
+	ErrBanned = errors.New("User is banned from the room")
+	// The message a history query pages from doesn't exist, or doesn't match the query
+	ErrUnknownCursor = errors.New("Could not find the message to page from")
 )
 
 type Repository struct {
@@ -42,32 +67,570 @@ func (r *Repository) InsertUser(userName, hashedPassword string) error {
 	return nil
 }
 
-func (r *Repository) CreateChatRoom(roomName, createdBy string) error {
-	result, err := r.dbConn.Exec(
-		"INSERT INTO chat_room (room_name, created_by) VALUES ($1, $2)",
-		roomName, createdBy,
+// Creates a chat room, with its creator as its owner
+func (r *Repository) CreateChatRoom(roomName, createdBy, visibility string) error {
+	tx, err := r.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	var roomId int
+	err = tx.QueryRow(
+		"INSERT INTO chat_room (room_name, created_by, visibility) VALUES ($1, $2, $3) RETURNING id",
+		roomName, createdBy, visibility,
+	).Scan(&roomId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	result, err := tx.Exec(
+		"INSERT INTO chat_member (chat_user_id, chat_room_id, role) "+
+			"SELECT id, $2, $3 FROM chat_user WHERE user_name = $1",
+		createdBy, roomId, models.RoleOwner,
 	)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
 
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
+		tx.Rollback()
 		return errors.New("Unable to create new chatroom")
 	}
+	return tx.Commit()
+}
+
+// Adds a user to a room. Adding an existing member has no effect.
+func (r *Repository) AddRoomMember(userName string, roomId int) error {
+	_, err := r.dbConn.Exec(
+		"INSERT INTO chat_member (chat_user_id, chat_room_id) SELECT id, $2 FROM chat_user WHERE user_name = $1 "+
+			"ON CONFLICT (chat_user_id, chat_room_id) DO NOTHING",
+		userName, roomId,
+	)
+	return err
+}
+
+// Returns a user's role in a room, or an empty string if they aren't a member
+func (r *Repository) GetMemberRole(userName string, roomId int) (string, error) {
+	var role string
+	err := r.dbConn.QueryRow(
+		"SELECT role FROM chat_member JOIN chat_user ON chat_user.id = chat_member.chat_user_id "+
+			"WHERE user_name = $1 AND chat_room_id = $2",
+		userName, roomId,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// Lists the members of a room along with their roles, sorted by name
+func (r *Repository) GetRoomMemberRoles(roomId int) ([]*models.RoomMember, error) {
+	rows, err := r.dbConn.Query(
+		"SELECT user_name, role, EXISTS (SELECT 1 FROM chat_mute "+
+			"WHERE chat_mute.chat_room_id = chat_member.chat_room_id AND chat_mute.user_name = chat_user.user_name) "+
+			"FROM chat_member JOIN chat_user ON chat_user.id = chat_member.chat_user_id "+
+			"WHERE chat_room_id = $1 ORDER BY user_name",
+		roomId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	members := []*models.RoomMember{}
+
+	defer rows.Close()
+	for rows.Next() {
+		member := &models.RoomMember{}
+		if err := rows.Scan(&member.UserName, &member.Role, &member.Muted); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return members, nil
+}
+
+func (r *Repository) SetMemberRole(userName string, roomId int, role string) error {
+	result, err := r.dbConn.Exec(
+		"UPDATE chat_member SET role = $3 FROM chat_user "+
+			"WHERE chat_user.id = chat_member.chat_user_id AND user_name = $1 AND chat_room_id = $2",
+		userName, roomId, role,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *Repository) RemoveRoomMember(userName string, roomId int) error {
+	result, err := r.dbConn.Exec(
+		"DELETE FROM chat_member USING chat_user "+
+			"WHERE chat_user.id = chat_member.chat_user_id AND user_name = $1 AND chat_room_id = $2",
+		userName, roomId,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Saves a room's name, topic, description and archived flag. If the room was renamed, its old name is kept as an
+// alias, so that it still finds the room.
+func (r *Repository) UpdateChatRoom(chatRoom *models.ChatRoom, oldName string) error {
+	tx, err := r.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	if chatRoom.RoomName != oldName {
+		// The new name may have belonged to a room that was renamed since, but it's the current name that counts
+		_, err = tx.Exec("DELETE FROM chat_room_alias WHERE room_name = $1", chatRoom.RoomName)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(
+			"INSERT INTO chat_room_alias (room_name, chat_room_id) VALUES ($1, $2) "+
+				"ON CONFLICT (room_name) DO UPDATE SET chat_room_id = EXCLUDED.chat_room_id, "+
+				"renamed_at = (now() AT TIME ZONE 'utc')",
+			oldName, chatRoom.Id,
+		)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	_, err = tx.Exec(
+		"UPDATE chat_room SET room_name = $2, topic = $3, description = $4, archived = $5 WHERE id = $1",
+		chatRoom.Id, chatRoom.RoomName, chatRoom.Topic, chatRoom.Description, chatRoom.Archived,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *Repository) CreateInvite(roomId int, invite *models.Invite, expiresAt time.Time) error {
+	var maxUses sql.NullInt64
+	if invite.MaxUses > 0 {
+		maxUses = sql.NullInt64{Int64: int64(invite.MaxUses), Valid: true}
+	}
+	var createdAt time.Time
+	err := r.dbConn.QueryRow(
+		"INSERT INTO chat_invite (token, chat_room_id, created_by, expires_at, max_uses) VALUES ($1, $2, $3, $4, $5) "+
+			"RETURNING created_at",
+		invite.Token, roomId, invite.CreatedBy, expiresAt.UTC(), maxUses,
+	).Scan(&createdAt)
+	if err != nil {
+		return err
+	}
+	invite.CreatedAt = formatTime(createdAt)
+	invite.ExpiresAt = formatTime(expiresAt)
+	return nil
+}
+
+// Lists the invites to a room that can still be used, newest first
+func (r *Repository) GetInvites(roomId int) ([]*models.Invite, error) {
+	rows, err := r.dbConn.Query(
+		"SELECT token, room_name, chat_invite.created_by, chat_invite.created_at, expires_at, max_uses, uses "+
+			"FROM chat_invite JOIN chat_room ON chat_room.id = chat_invite.chat_room_id "+
+			"WHERE chat_room_id = $1 AND revoked_at IS NULL AND expires_at > (now() AT TIME ZONE 'utc') "+
+			"AND (max_uses IS NULL OR uses < max_uses) "+
+			"ORDER BY chat_invite.created_at DESC",
+		roomId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	invites := []*models.Invite{}
+
+	defer rows.Close()
+	for rows.Next() {
+		invite := &models.Invite{}
+		var createdAt, expiresAt time.Time
+		var maxUses sql.NullInt64
+		err := rows.Scan(
+			&invite.Token, &invite.RoomName, &invite.CreatedBy, &createdAt, &expiresAt, &maxUses, &invite.Uses,
+		)
+		if err != nil {
+			return nil, err
+		}
+		invite.CreatedAt = formatTime(createdAt)
+		invite.ExpiresAt = formatTime(expiresAt)
+		invite.MaxUses = int(maxUses.Int64)
+		invites = append(invites, invite)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return invites, nil
+}
+
+func (r *Repository) RevokeInvite(roomId int, token string) error {
+	result, err := r.dbConn.Exec(
+		"UPDATE chat_invite SET revoked_at = (now() AT TIME ZONE 'utc') "+
+			"WHERE chat_room_id = $1 AND token = $2 AND revoked_at IS NULL",
+		roomId, token,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// Adds the user to an invite's room, returning the room's ID. Only users who weren't already members use up the
+// invite. Returns sql.ErrNoRows if the invite doesn't exist, or has expired, been revoked or been used up, and
+// ErrBanned if the user is banned from the room.
+func (r *Repository) AcceptInvite(token, userName string) (int, error) {
+	tx, err := r.dbConn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	var roomId int
+	// Locking the invite makes concurrent accepts take turns, so they can't go over the limit between checking it
+	// and counting the use
+	err = tx.QueryRow(
+		"SELECT chat_room_id FROM chat_invite "+
+			"WHERE token = $1 AND revoked_at IS NULL AND expires_at > (now() AT TIME ZONE 'utc') "+
+			"AND (max_uses IS NULL OR uses < max_uses) "+
+			"FOR UPDATE",
+		token,
+	).Scan(&roomId)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	var banned bool
+	if err := tx.QueryRow(selectIsBanned, userName, roomId).Scan(&banned); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if banned {
+		tx.Rollback()
+		return 0, ErrBanned
+	}
+	result, err := tx.Exec(
+		"INSERT INTO chat_member (chat_user_id, chat_room_id) SELECT id, $2 FROM chat_user WHERE user_name = $1 "+
+			"ON CONFLICT (chat_user_id, chat_room_id) DO NOTHING",
+		userName, roomId,
+	)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	// Members who follow the link again don't use it up
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected > 0 {
+		if _, err := tx.Exec("UPDATE chat_invite SET uses = uses + 1 WHERE token = $1", token); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+	}
+	return roomId, tx.Commit()
+}
+
+// Bans a user from a room until expiresAt, or forever if it's nil, and removes them from its members. Banning a
+// user who is already banned replaces the old ban.
+func (r *Repository) BanUser(roomId int, userName, bannedBy, reason string, expiresAt *time.Time) error {
+	var expiry sql.NullTime
+	if expiresAt != nil {
+		expiry = sql.NullTime{Time: expiresAt.UTC(), Valid: true}
+	}
+	tx, err := r.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO chat_ban (chat_room_id, user_name, banned_by, reason, expires_at) VALUES ($1, $2, $3, $4, $5) "+
+			"ON CONFLICT (chat_room_id, user_name) DO UPDATE SET banned_by = EXCLUDED.banned_by, "+
+			"reason = EXCLUDED.reason, banned_at = (now() AT TIME ZONE 'utc'), expires_at = EXCLUDED.expires_at",
+		roomId, userName, bannedBy, reason, expiry,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(
+		"DELETE FROM chat_member USING chat_user "+
+			"WHERE chat_user.id = chat_member.chat_user_id AND user_name = $1 AND chat_room_id = $2",
+		userName, roomId,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *Repository) UnbanUser(roomId int, userName string) error {
+	result, err := r.dbConn.Exec("DELETE FROM chat_ban WHERE chat_room_id = $1 AND user_name = $2", roomId, userName)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *Repository) IsBanned(userName string, roomId int) (bool, error) {
+	var banned bool
+	err := r.dbConn.QueryRow(selectIsBanned, userName, roomId).Scan(&banned)
+	return banned, err
+}
+
+// Lists the bans in a room that haven't expired, newest first
+func (r *Repository) GetBans(roomId int) ([]*models.Ban, error) {
+	rows, err := r.dbConn.Query(
+		"SELECT user_name, banned_by, reason, banned_at, expires_at FROM chat_ban "+
+			"WHERE chat_room_id = $1 AND (expires_at IS NULL OR expires_at > (now() AT TIME ZONE 'utc')) "+
+			"ORDER BY banned_at DESC",
+		roomId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	bans := []*models.Ban{}
+
+	defer rows.Close()
+	for rows.Next() {
+		ban := &models.Ban{}
+		var bannedAt time.Time
+		var expiresAt sql.NullTime
+		if err := rows.Scan(&ban.UserName, &ban.BannedBy, &ban.Reason, &bannedAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		ban.BannedAt = formatTime(bannedAt)
+		if expiresAt.Valid {
+			ban.ExpiresAt = formatTime(expiresAt.Time)
+		}
+		bans = append(bans, ban)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return bans, nil
+}
+
+// Mutes a member of a room. The mute stays if they leave, until a moderator unmutes them. Returns sql.ErrNoRows if
+// the user isn't a member.
+func (r *Repository) MuteUser(roomId int, userName, mutedBy string) error {
+	result, err := r.dbConn.Exec(
+		"INSERT INTO chat_mute (chat_room_id, user_name, muted_by) SELECT $1, $2, $3 "+
+			"WHERE EXISTS (SELECT 1 FROM chat_member JOIN chat_user ON chat_user.id = chat_member.chat_user_id "+
+			"WHERE user_name = $2 AND chat_room_id = $1) "+
+			"ON CONFLICT (chat_room_id, user_name) DO UPDATE SET muted_by = EXCLUDED.muted_by, "+
+			"muted_at = (now() AT TIME ZONE 'utc')",
+		roomId, userName, mutedBy,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *Repository) UnmuteUser(roomId int, userName string) error {
+	result, err := r.dbConn.Exec("DELETE FROM chat_mute WHERE chat_room_id = $1 AND user_name = $2", roomId, userName)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
 
-func (r *Repository) DeleteChatRoom(roomName string) error {
-	_, err := r.dbConn.Exec("DELETE FROM chat_room WHERE room_name=$1", roomName)
+func (r *Repository) IsMuted(userName string, roomId int) (bool, error) {
+	var muted bool
+	err := r.dbConn.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM chat_mute WHERE user_name = $1 AND chat_room_id = $2)",
+		userName, roomId,
+	).Scan(&muted)
+	return muted, err
+}
+
+func (r *Repository) SetSlowMode(roomId, seconds int) error {
+	_, err := r.dbConn.Exec("UPDATE chat_room SET slow_mode_seconds = $2 WHERE id = $1", roomId, seconds)
+	return err
+}
+
+// Returns when a user last sent a message to a room, or the zero time if they never have
+func (r *Repository) GetLastMessageTime(userName string, roomId int) (time.Time, error) {
+	var timeSent sql.NullTime
+	err := r.dbConn.QueryRow(
+		"SELECT max(time_sent) FROM chat_message WHERE chat_room_id = $1 AND sent_by = $2",
+		roomId, userName,
+	).Scan(&timeSent)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return timeSent.Time, nil
+}
+
+// Pins a message, filling in who pinned it and when. Pinning a message twice has no effect, and leaves the pin as it
+// was, in which case added is false.
+func (r *Repository) PinMessage(roomId int, pin *models.Pin) (bool, error) {
+	result, err := r.dbConn.Exec(
+		"INSERT INTO chat_pin (chat_message_id, chat_room_id, pinned_by) VALUES ($1, $2, $3) "+
+			"ON CONFLICT (chat_message_id) DO NOTHING",
+		pin.Message.Id, roomId, pin.PinnedBy,
+	)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+
+	var pinnedAt time.Time
+	err = r.dbConn.QueryRow(
+		"SELECT pinned_by, pinned_at FROM chat_pin WHERE chat_message_id = $1", pin.Message.Id,
+	).Scan(&pin.PinnedBy, &pinnedAt)
+	if err != nil {
+		return false, err
+	}
+	pin.PinnedAt = formatTime(pinnedAt)
+	return rowsAffected > 0, nil
+}
+
+func (r *Repository) UnpinMessage(roomId, messageId int) error {
+	result, err := r.dbConn.Exec(
+		"DELETE FROM chat_pin WHERE chat_room_id = $1 AND chat_message_id = $2",
+		roomId, messageId,
+	)
 	if err != nil {
 		return err
 	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
 	return nil
 }
 
-func (r *Repository) ListChatRooms() (*models.ChatRoomList, error) {
-	rows, err := r.dbConn.Query("SELECT id, room_name, created_by FROM chat_room")
+// Lists the pinned messages in a room that haven't been deleted, oldest pin first
+func (r *Repository) GetPins(roomId int) (*models.PinList, error) {
+	rows, err := r.dbConn.Query(
+		"SELECT chat_message.id, time_sent, sent_by, contents, edited_at, deleted_at, parent_id, "+
+			"(SELECT count(*) FROM chat_message AS reply WHERE reply.parent_id = chat_message.id), "+
+			"pinned_by, pinned_at "+
+			"FROM chat_pin "+
+			"JOIN chat_message ON chat_message.id = chat_pin.chat_message_id "+
+			"WHERE chat_pin.chat_room_id = $1 AND deleted_at IS NULL "+
+			"ORDER BY pinned_at, chat_message.id",
+		roomId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	pinList := &models.PinList{
+		Pins: []*models.Pin{},
+	}
+	chatMessages := []*models.ChatMessage{}
+
+	defer rows.Close()
+	for rows.Next() {
+		pin := &models.Pin{}
+		var pinnedAt time.Time
+		pin.Message, err = scanChatMessage(rows, &pin.PinnedBy, &pinnedAt)
+		if err != nil {
+			return nil, err
+		}
+		pin.PinnedAt = formatTime(pinnedAt)
+		pinList.Pins = append(pinList.Pins, pin)
+		chatMessages = append(chatMessages, pin.Message)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	if err := r.attachReactions(chatMessages); err != nil {
+		return nil, err
+	}
+	if err := r.attachMentions(chatMessages); err != nil {
+		return nil, err
+	}
+	return pinList, nil
+}
+
+// Deletes a room along with everything in it. Returns sql.ErrNoRows if the room doesn't exist.
+func (r *Repository) DeleteChatRoom(roomId int) error {
+	tx, err := r.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	// Rows that reference messages go first, then the messages themselves, then everything else in the room
+	statements := []string{
+		"DELETE FROM chat_reaction WHERE chat_message_id IN (SELECT id FROM chat_message WHERE chat_room_id = $1)",
+		"DELETE FROM chat_mention WHERE chat_message_id IN (SELECT id FROM chat_message WHERE chat_room_id = $1)",
+		"DELETE FROM chat_pin WHERE chat_room_id = $1",
+		"DELETE FROM chat_member WHERE chat_room_id = $1",
+		"DELETE FROM chat_message WHERE chat_room_id = $1",
+		"DELETE FROM chat_invite WHERE chat_room_id = $1",
+		"DELETE FROM chat_ban WHERE chat_room_id = $1",
+		"DELETE FROM chat_mute WHERE chat_room_id = $1",
+		"DELETE FROM chat_room_alias WHERE chat_room_id = $1",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, roomId); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	result, err := tx.Exec("DELETE FROM chat_room WHERE id = $1", roomId)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		tx.Rollback()
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// Lists the chat rooms a user can see, along with how many messages in each one they haven't read. Private rooms
+// are only listed for their members, and archived rooms are only listed if includeArchived is set.
+func (r *Repository) ListChatRooms(userName string, includeArchived bool) (*models.ChatRoomList, error) {
+	rows, err := r.dbConn.Query(
+		"SELECT "+chatRoomColumns+", COALESCE(chat_member.role, ''), "+
+			"(SELECT count(*) FROM chat_message WHERE chat_message.chat_room_id = chat_room.id "+
+			"AND parent_id IS NULL AND deleted_at IS NULL AND sent_by <> $1 "+
+			"AND chat_message.id > COALESCE(chat_member.last_read_message_id, 0)), "+
+			"ARRAY(SELECT user_name FROM chat_member AS member JOIN chat_user ON chat_user.id = member.chat_user_id "+
+			"WHERE member.chat_room_id = chat_room.id AND is_direct ORDER BY user_name) "+
+			"FROM chat_room "+
+			"LEFT JOIN chat_member ON chat_member.chat_room_id = chat_room.id "+
+			"AND chat_member.chat_user_id = (SELECT id FROM chat_user WHERE user_name = $1) "+
+			"WHERE (visibility = 'public' OR chat_member.chat_user_id IS NOT NULL) AND (NOT archived OR $2) "+
+			"ORDER BY room_name",
+		userName, includeArchived,
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -77,7 +640,8 @@ func (r *Repository) ListChatRooms() (*models.ChatRoomList, error) {
 	defer rows.Close()
 	for rows.Next() {
 		chatRoom := &models.ChatRoom{}
-		if err := rows.Scan(&chatRoom.Id, &chatRoom.RoomName, &chatRoom.CreatedBy); err != nil {
+		err := scanChatRoomInto(rows, chatRoom, &chatRoom.Role, &chatRoom.UnreadCount, pq.Array(&chatRoom.Members))
+		if err != nil {
 			return nil, err
 		}
 		chatRoomList.Results = append(chatRoomList.Results, chatRoom)
@@ -88,20 +652,325 @@ func (r *Repository) ListChatRooms() (*models.ChatRoomList, error) {
 	return chatRoomList, nil
 }
 
+// Finds a room by its current name, or by a name it had before being renamed
 func (r *Repository) FindChatRoomByName(roomName string) (*models.ChatRoom, error) {
-	row := r.dbConn.QueryRow("SELECT id, room_name, created_by FROM chat_room WHERE room_name=$1", roomName)
+	row := r.dbConn.QueryRow(selectChatRooms+"WHERE room_name=$1", roomName)
+	chatRoom, err := scanChatRoom(row)
+	if err != sql.ErrNoRows {
+		return chatRoom, err
+	}
+	row = r.dbConn.QueryRow(
+		selectChatRooms+"WHERE id = (SELECT chat_room_id FROM chat_room_alias WHERE room_name = $1)",
+		roomName,
+	)
+	return scanChatRoom(row)
+}
+
+// Saves a chat message, and returns its ID
+func (r *Repository) InsertChatMessage(roomId int, message *models.ChatMessage) (int, error) {
+	var parentId sql.NullInt64
+	if message.ParentId > 0 {
+		parentId = sql.NullInt64{Int64: int64(message.ParentId), Valid: true}
+	}
+	var id int
+	err := r.dbConn.QueryRow(
+		"INSERT INTO chat_message (time_sent, sent_by, chat_room_id, contents, parent_id) "+
+			"VALUES ($1::timestamp, $2, $3, $4, $5) RETURNING id",
+		message.TimeSent, message.SentBy, roomId, message.Contents, parentId,
+	).Scan(&id)
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// Returns a page of top level chat messages in a room, according to the cursor in the query. Replies are left out,
+// and can be fetched with GetThreadReplies.
+func (r *Repository) GetChatMessagesByRoomId(roomId int, query *models.HistoryQuery) (*models.HistoryPage, error) {
+	return r.getChatMessagePage("chat_room_id = $1 AND parent_id IS NULL", roomId, query)
+}
+
+// Returns a page of replies to a message, according to the cursor in the query
+func (r *Repository) GetThreadReplies(parentId int, query *models.HistoryQuery) (*models.HistoryPage, error) {
+	return r.getChatMessagePage("parent_id = $1", parentId, query)
+}
+
+// Selects a page of chat messages matching a filter, which takes a single argument as $1
+func (r *Repository) getChatMessagePage(filter string, filterArg int, query *models.HistoryQuery) (*models.HistoryPage, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	} else if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	// Messages are paged by ID rather than time sent. IDs follow the order messages were saved in, while times
+	// only have a precision of a second and are stamped before saving, so concurrent messages can be saved out of
+	// order. Paging by time could skip a message when resuming.
+	cursor := query.After
+	if query.Before > 0 {
+		cursor = query.Before
+	}
+	if cursor > 0 {
+		var exists bool
+		err := r.dbConn.QueryRow(
+			"SELECT EXISTS (SELECT 1 FROM chat_message WHERE "+filter+" AND id = $2)",
+			filterArg, cursor,
+		).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, ErrUnknownCursor
+		}
+	}
+
+	// Fetch one extra message to find out whether there are more after this page
+	var rows *sql.Rows
+	var err error
+	newestFirst := true
+	switch {
+	case query.After > 0:
+		newestFirst = false
+		rows, err = r.dbConn.Query(
+			selectChatMessages+"WHERE "+filter+" AND id > $2 ORDER BY id LIMIT $3",
+			filterArg, query.After, limit+1)
+	case query.Before > 0:
+		rows, err = r.dbConn.Query(
+			selectChatMessages+"WHERE "+filter+" AND id < $2 ORDER BY id DESC LIMIT $3",
+			filterArg, query.Before, limit+1)
+	default:
+		rows, err = r.dbConn.Query(
+			selectChatMessages+"WHERE "+filter+" ORDER BY id DESC LIMIT $2",
+			filterArg, limit+1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	chatMessages, err := scanChatMessages(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &models.HistoryPage{Messages: chatMessages}
+	if len(page.Messages) > limit {
+		page.HasMore = true
+		page.Messages = page.Messages[:limit]
+	}
+	if newestFirst {
+		// Pages are always returned oldest first
+		for i, j := 0, len(page.Messages)-1; i < j; i, j = i+1, j-1 {
+			page.Messages[i], page.Messages[j] = page.Messages[j], page.Messages[i]
+		}
+	}
+	if err := r.attachReactions(page.Messages); err != nil {
+		return nil, err
+	}
+	if err := r.attachMentions(page.Messages); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+func scanChatMessages(rows *sql.Rows) ([]*models.ChatMessage, error) {
+	chatMessages := []*models.ChatMessage{}
+
+	defer rows.Close()
+	for rows.Next() {
+		chatMessage, err := scanChatMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		chatMessages = append(chatMessages, chatMessage)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return chatMessages, nil
+}
+
+// Scans a row selected with selectChatMessages, followed by any extra columns
+func scanChatMessage(row interface {
+	Scan(dest ...interface{}) error
+}, extra ...interface{}) (*models.ChatMessage, error) {
+	chatMessage := &models.ChatMessage{}
+	var timeSent time.Time
+	var editedAt, deletedAt sql.NullTime
+	var parentId sql.NullInt64
+	dest := []interface{}{
+		&chatMessage.Id, &timeSent, &chatMessage.SentBy, &chatMessage.Contents, &editedAt, &deletedAt, &parentId,
+		&chatMessage.ReplyCount,
+	}
+	err := row.Scan(append(dest, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	chatMessage.ParentId = int(parentId.Int64)
+	// Timestamps are stored in UTC
+	chatMessage.TimeSent = formatTime(timeSent)
+	if editedAt.Valid {
+		chatMessage.EditedAt = formatTime(editedAt.Time)
+	}
+	if deletedAt.Valid {
+		chatMessage.Deleted = true
+		chatMessage.Contents = ""
+	}
+	return chatMessage, nil
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// Finds a chat message by ID, as long as it was sent to the given room
+func (r *Repository) FindChatMessage(roomId, messageId int) (*models.ChatMessage, error) {
+	row := r.dbConn.QueryRow(selectChatMessages+"WHERE chat_room_id = $1 AND id = $2", roomId, messageId)
+	return scanChatMessage(row)
+}
+
+func (r *Repository) UpdateChatMessageContents(messageId int, contents, editedAt string) error {
+	result, err := r.dbConn.Exec(
+		"UPDATE chat_message SET contents = $1, edited_at = $2::timestamp WHERE id = $3",
+		contents, editedAt, messageId,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return errors.New("Unable to edit chat message")
+	}
+	return nil
+}
+
+// Marks a chat message as deleted, and clears out its contents
+func (r *Repository) DeleteChatMessage(messageId int, deletedAt string) error {
+	result, err := r.dbConn.Exec(
+		"UPDATE chat_message SET contents = '', deleted_at = $1::timestamp WHERE id = $2",
+		deletedAt, messageId,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		return errors.New("Unable to delete chat message")
+	}
+	return nil
+}
+
+func (r *Repository) FindChatRoomById(roomId int) (*models.ChatRoom, error) {
+	row := r.dbConn.QueryRow(selectChatRooms+"WHERE id=$1", roomId)
+	return scanChatRoom(row)
+}
+
+func scanChatRoom(row *sql.Row) (*models.ChatRoom, error) {
 	chatRoom := &models.ChatRoom{}
-	if err := row.Scan(&chatRoom.Id, &chatRoom.RoomName, &chatRoom.CreatedBy); err != nil {
+	if err := scanChatRoomInto(row, chatRoom); err != nil {
 		return nil, err
 	}
 	return chatRoom, nil
 }
 
-func (r *Repository) InsertChatMessage(roomId int, message *models.ChatMessage) error {
+// Scans the chatRoomColumns of a row, followed by any extra columns
+func scanChatRoomInto(row interface {
+	Scan(dest ...interface{}) error
+}, chatRoom *models.ChatRoom, extra ...interface{}) error {
+	var createdAt time.Time
+	dest := []interface{}{
+		&chatRoom.Id, &chatRoom.RoomName, &chatRoom.CreatedBy, &chatRoom.Visibility, &chatRoom.Direct,
+		&chatRoom.SlowModeSeconds, &chatRoom.Topic, &chatRoom.Description, &createdAt, &chatRoom.Archived,
+	}
+	if err := row.Scan(append(dest, extra...)...); err != nil {
+		return err
+	}
+	chatRoom.CreatedAt = formatTime(createdAt)
+	return nil
+}
+
+// Adds a reaction to a message. Reacting twice with the same emoji has no effect.
+func (r *Repository) AddReaction(messageId int, userName, emoji string) error {
+	_, err := r.dbConn.Exec(
+		"INSERT INTO chat_reaction (chat_message_id, user_name, emoji) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		messageId, userName, emoji,
+	)
+	return err
+}
+
+func (r *Repository) RemoveReaction(messageId int, userName, emoji string) error {
+	_, err := r.dbConn.Exec(
+		"DELETE FROM chat_reaction WHERE chat_message_id = $1 AND user_name = $2 AND emoji = $3",
+		messageId, userName, emoji,
+	)
+	return err
+}
+
+// Returns the reactions on each of the given messages, keyed by message ID
+func (r *Repository) GetReactionsByMessageIds(messageIds []int64) (map[int][]*models.Reaction, error) {
+	rows, err := r.dbConn.Query(
+		"SELECT chat_message_id, emoji, user_name FROM chat_reaction WHERE chat_message_id = ANY($1) "+
+			"ORDER BY chat_message_id, reacted_at",
+		pq.Array(messageIds),
+	)
+	if err != nil {
+		return nil, err
+	}
+	reactions := make(map[int][]*models.Reaction)
+
+	defer rows.Close()
+	for rows.Next() {
+		var messageId int
+		var emoji, userName string
+		if err := rows.Scan(&messageId, &emoji, &userName); err != nil {
+			return nil, err
+		}
+		var reaction *models.Reaction
+		for _, existing := range reactions[messageId] {
+			if existing.Emoji == emoji {
+				reaction = existing
+				break
+			}
+		}
+		if reaction == nil {
+			reaction = &models.Reaction{Emoji: emoji, Users: []string{}}
+			reactions[messageId] = append(reactions[messageId], reaction)
+		}
+		reaction.Count++
+		reaction.Users = append(reaction.Users, userName)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return reactions, nil
+}
+
+func (r *Repository) attachReactions(chatMessages []*models.ChatMessage) error {
+	if len(chatMessages) == 0 {
+		return nil
+	}
+	messageIds := make([]int64, len(chatMessages))
+	for i, chatMessage := range chatMessages {
+		messageIds[i] = int64(chatMessage.Id)
+	}
+	reactions, err := r.GetReactionsByMessageIds(messageIds)
+	if err != nil {
+		return err
+	}
+	for _, chatMessage := range chatMessages {
+		chatMessage.Reactions = reactions[chatMessage.Id]
+	}
+	return nil
+}
+
+// Moves a member's read position in a room forward to the given message. Read positions never move backwards.
+// Returns sql.ErrNoRows if the user isn't a member, rather than making them one.
+func (r *Repository) UpdateReadPosition(userName string, roomId, messageId int) error {
 	result, err := r.dbConn.Exec(
-		"INSERT INTO chat_message (time_sent, sent_by, chat_room_id, contents) "+
-			"VALUES ($1::timestamp, $2, $3, $4)",
-		message.TimeSent, message.SentBy, roomId, message.Contents,
+		"UPDATE chat_member SET last_read_message_id = GREATEST(last_read_message_id, $3) FROM chat_user "+
+			"WHERE chat_user.id = chat_member.chat_user_id AND user_name = $1 AND chat_room_id = $2",
+		userName, roomId, messageId,
 	)
 	if err != nil {
 		return err
@@ -109,30 +978,234 @@ func (r *Repository) InsertChatMessage(roomId int, message *models.ChatMessage)
 
 	rowsAffected, _ := result.RowsAffected()
 	if rowsAffected == 0 {
-		return errors.New("Unable to insert chat message")
+		return sql.ErrNoRows
 	}
 	return nil
 }
 
-func (r *Repository) GetChatMessagesByRoomId(roomId int) ([]*models.ChatMessage, error) {
+// Returns which of the given names belong to registered users
+func (r *Repository) FindExistingUserNames(names []string) ([]string, error) {
+	rows, err := r.dbConn.Query("SELECT user_name FROM chat_user WHERE user_name = ANY($1)", pq.Array(names))
+	if err != nil {
+		return nil, err
+	}
+	userNames := []string{}
+
+	defer rows.Close()
+	for rows.Next() {
+		var userName string
+		if err := rows.Scan(&userName); err != nil {
+			return nil, err
+		}
+		userNames = append(userNames, userName)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return userNames, nil
+}
+
+// Returns which of the given names belong to users who can see a room, either because it's public or because
+// they're members
+func (r *Repository) FindRoomUserNames(roomId int, names []string) ([]string, error) {
 	rows, err := r.dbConn.Query(
-		"SELECT time_sent, sent_by, contents FROM chat_message WHERE chat_message.chat_room_id = $1",
-		roomId)
+		"SELECT user_name FROM chat_user WHERE user_name = ANY($2) AND ("+
+			"EXISTS (SELECT 1 FROM chat_room WHERE id = $1 AND visibility = 'public') OR "+
+			"EXISTS (SELECT 1 FROM chat_member WHERE chat_member.chat_user_id = chat_user.id AND chat_room_id = $1))",
+		roomId, pq.Array(names),
+	)
 	if err != nil {
 		return nil, err
 	}
-	chatMessages := []*models.ChatMessage{}
+	userNames := []string{}
 
 	defer rows.Close()
 	for rows.Next() {
-		chatMessage := &models.ChatMessage{}
-		if err := rows.Scan(&chatMessage.TimeSent, &chatMessage.SentBy, &chatMessage.Contents); err != nil {
+		var userName string
+		if err := rows.Scan(&userName); err != nil {
 			return nil, err
 		}
-		chatMessages = append(chatMessages, chatMessage)
+		userNames = append(userNames, userName)
 	}
 	if rows.Err() != nil {
 		return nil, rows.Err()
 	}
-	return chatMessages, nil
+	return userNames, nil
+}
+
+// Replaces the users mentioned in a message
+func (r *Repository) SetMentions(messageId int, userNames []string) error {
+	tx, err := r.dbConn.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM chat_mention WHERE chat_message_id = $1", messageId); err != nil {
+		tx.Rollback()
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO chat_mention (chat_message_id, chat_user_id) "+
+			"SELECT $1, id FROM chat_user WHERE user_name = ANY($2)",
+		messageId, pq.Array(userNames),
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// Returns the most recent messages that mentioned a user, newest first. Messages in private rooms the user isn't a
+// member of are left out.
+func (r *Repository) GetMentionsForUser(userName string, limit int) (*models.MentionList, error) {
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	} else if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+	// Mentions are shown on their own, so they leave out reply counts
+	rows, err := r.dbConn.Query(
+		"SELECT chat_message.id, time_sent, sent_by, contents, edited_at, deleted_at, parent_id, 0, room_name "+
+			"FROM chat_mention "+
+			"JOIN chat_message ON chat_message.id = chat_mention.chat_message_id "+
+			"JOIN chat_room ON chat_room.id = chat_message.chat_room_id "+
+			"WHERE chat_mention.chat_user_id = (SELECT id FROM chat_user WHERE user_name = $1) "+
+			"AND deleted_at IS NULL "+
+			"AND (visibility = 'public' OR EXISTS (SELECT 1 FROM chat_member "+
+			"WHERE chat_member.chat_room_id = chat_room.id AND chat_member.chat_user_id = chat_mention.chat_user_id)) "+
+			"ORDER BY time_sent DESC, chat_message.id DESC LIMIT $2",
+		userName, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	mentionList := &models.MentionList{
+		Results: []*models.Mention{},
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		mention := &models.Mention{}
+		mention.Message, err = scanChatMessage(rows, &mention.RoomName)
+		if err != nil {
+			return nil, err
+		}
+		mentionList.Results = append(mentionList.Results, mention)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return mentionList, nil
+}
+
+func (r *Repository) attachMentions(chatMessages []*models.ChatMessage) error {
+	if len(chatMessages) == 0 {
+		return nil
+	}
+	messageIds := make([]int64, len(chatMessages))
+	byId := make(map[int]*models.ChatMessage)
+	for i, chatMessage := range chatMessages {
+		messageIds[i] = int64(chatMessage.Id)
+		byId[chatMessage.Id] = chatMessage
+	}
+	rows, err := r.dbConn.Query(
+		"SELECT chat_message_id, user_name FROM chat_mention "+
+			"JOIN chat_user ON chat_user.id = chat_mention.chat_user_id "+
+			"WHERE chat_message_id = ANY($1) ORDER BY user_name",
+		pq.Array(messageIds),
+	)
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var messageId int
+		var userName string
+		if err := rows.Scan(&messageId, &userName); err != nil {
+			return err
+		}
+		byId[messageId].Mentions = append(byId[messageId].Mentions, userName)
+	}
+	return rows.Err()
+}
+
+// Finds or creates the direct conversation with the given name, and makes sure all the given users are members
+func (r *Repository) CreateDirectRoom(roomName, createdBy string, members []string) (*models.ChatRoom, error) {
+	tx, err := r.dbConn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO chat_room (room_name, created_by, visibility, is_direct) VALUES ($1, $2, 'private', true) "+
+			"ON CONFLICT (room_name) DO NOTHING",
+		roomName, createdBy,
+	)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO chat_member (chat_user_id, chat_room_id) "+
+			"SELECT chat_user.id, chat_room.id FROM chat_user, chat_room "+
+			"WHERE chat_user.user_name = ANY($1) AND chat_room.room_name = $2 AND chat_room.is_direct "+
+			"ON CONFLICT (chat_user_id, chat_room_id) DO NOTHING",
+		pq.Array(members), roomName,
+	)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	chatRoom, err := r.FindChatRoomByName(roomName)
+	if err != nil {
+		return nil, err
+	}
+	if !chatRoom.Direct {
+		return nil, errors.New("A chat room with that name already exists")
+	}
+	chatRoom.Members, err = r.GetRoomMembers(chatRoom.Id)
+	if err != nil {
+		return nil, err
+	}
+	return chatRoom, nil
+}
+
+// Returns the names of a room's members, sorted
+func (r *Repository) GetRoomMembers(roomId int) ([]string, error) {
+	rows, err := r.dbConn.Query(
+		"SELECT user_name FROM chat_member JOIN chat_user ON chat_user.id = chat_member.chat_user_id "+
+			"WHERE chat_room_id = $1 ORDER BY user_name",
+		roomId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	members := []string{}
+
+	defer rows.Close()
+	for rows.Next() {
+		var userName string
+		if err := rows.Scan(&userName); err != nil {
+			return nil, err
+		}
+		members = append(members, userName)
+	}
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+	return members, nil
+}
+
+func (r *Repository) IsRoomMember(userName string, roomId int) (bool, error) {
+	var isMember bool
+	err := r.dbConn.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM chat_member JOIN chat_user ON chat_user.id = chat_member.chat_user_id "+
+			"WHERE user_name = $1 AND chat_room_id = $2)",
+		userName, roomId,
+	).Scan(&isMember)
+	return isMember, err
 }
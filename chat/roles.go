@@ -0,0 +1,43 @@
+package chat
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/eshyong/chatapp/chat/models"
+)
+
+// Higher roles can do everything lower roles can. Users who aren't members have no rank.
+var roleRanks = map[string]int{
+	models.RoleMember:    1,
+	models.RoleModerator: 2,
+	models.RoleOwner:     3,
+}
+
+func isValidRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// Returns whether a user has at least the given role in a room
+func (app *Application) hasRole(userName string, roomId int, role string) (bool, *appError) {
+	userRole, err := app.repository.GetMemberRole(userName, roomId)
+	if err != nil {
+		log.Println(err)
+		return false, internalError()
+	}
+	return roleRanks[userRole] >= roleRanks[role], nil
+}
+
+// Checks that a user has at least the given role in a room, and returns a Forbidden error with the given message
+// if they don't
+func (app *Application) requireRole(userName string, roomId int, role, message string) *appError {
+	ok, appErr := app.hasRole(userName, roomId, role)
+	if appErr != nil {
+		return appErr
+	}
+	if !ok {
+		return newAppError(http.StatusForbidden, message)
+	}
+	return nil
+}
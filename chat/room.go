@@ -0,0 +1,325 @@
+package chat
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// How long a typing indicator lasts unless the client renews it, so that a client that crashes mid-sentence
+	// doesn't leave it on forever
+	typingTimeout = 5 * time.Second
+	// How often the hub checks for expired typing indicators
+	typingCheckInterval = time.Second
+)
+
+// A message for the hub to deliver. By default it goes to every session in the room.
+type roomBroadcast struct {
+	// Skip this session, usually the one that sent the message
+	exclude *ChatSession
+	// Only deliver the message to this session
+	recipient *ChatSession
+	// Only deliver the message to sessions subscribed to the thread with this parent message ID
+	thread  int
+	message *models.WsServerMessage
+}
+
+type typingUpdate struct {
+	session *ChatSession
+	typing  bool
+}
+
+// Disconnects every session a user has in the room, or a single session
+type roomKick struct {
+	// Everyone is disconnected if neither of these is set
+	userName  string
+	session   *ChatSession
+	closeCode int
+	reason    string
+}
+
+type threadSubscription struct {
+	session   *ChatSession
+	parentId  int
+	subscribe bool
+}
+
+// A ChatRoom is run by a single hub goroutine, which owns the set of sessions in the room. All joins, leaves and
+// broadcasts go through the hub's channels, so they never race with each other.
+type ChatRoom struct {
+	roomId       int
+	chatSessions map[*ChatSession]bool
+
+	register      chan *ChatSession
+	unregister    chan *ChatSession
+	broadcast     chan *roomBroadcast
+	subscriptions chan *threadSubscription
+	typingUpdates chan *typingUpdate
+	kicks         chan *roomKick
+	// Requests for the names of everyone in the room
+	rosterRequests chan chan []string
+
+	// When the typing indicator for each session that is currently typing expires
+	typing map[*ChatSession]time.Time
+
+	// Closed when the hub shuts down, after the last session has left
+	done chan struct{}
+}
+
+func newChatRoom(roomId int) *ChatRoom {
+	return &ChatRoom{
+		roomId:         roomId,
+		chatSessions:   make(map[*ChatSession]bool),
+		register:       make(chan *ChatSession),
+		unregister:     make(chan *ChatSession),
+		broadcast:      make(chan *roomBroadcast),
+		subscriptions:  make(chan *threadSubscription),
+		typingUpdates:  make(chan *typingUpdate),
+		kicks:          make(chan *roomKick),
+		rosterRequests: make(chan chan []string),
+		typing:         make(map[*ChatSession]time.Time),
+		done:           make(chan struct{}),
+	}
+}
+
+// Runs the hub until the last session leaves. onEmpty is called from the hub goroutine before it shuts down, so
+// the room can be removed from the directory before anyone else gets a chance to join it.
+func (room *ChatRoom) run(onEmpty func(room *ChatRoom)) {
+	defer close(room.done)
+	typingTicker := time.NewTicker(typingCheckInterval)
+	defer typingTicker.Stop()
+	for {
+		select {
+		case session := <-room.register:
+			room.addSession(session)
+		case session := <-room.unregister:
+			room.removeSession(session, websocket.CloseNormalClosure, "")
+		case broadcast := <-room.broadcast:
+			if broadcast.recipient != nil {
+				room.deliver(broadcast.recipient, broadcast.message)
+			} else if broadcast.thread != 0 {
+				room.fanOutToThread(broadcast.thread, broadcast.message)
+			} else {
+				room.fanOut(broadcast.exclude, broadcast.message)
+			}
+		case subscription := <-room.subscriptions:
+			if subscription.subscribe {
+				subscription.session.threads[subscription.parentId] = true
+			} else {
+				delete(subscription.session.threads, subscription.parentId)
+			}
+		case reply := <-room.rosterRequests:
+			reply <- room.onlineUsers()
+		case update := <-room.typingUpdates:
+			room.setTyping(update.session, update.typing)
+		case kick := <-room.kicks:
+			for session := range room.chatSessions {
+				if (kick.userName == "" || session.UserName == kick.userName) &&
+					(kick.session == nil || session == kick.session) {
+					room.removeSession(session, kick.closeCode, kick.reason)
+				}
+			}
+		case now := <-typingTicker.C:
+			for session, expiry := range room.typing {
+				if now.After(expiry) {
+					room.setTyping(session, false)
+				}
+			}
+		}
+		if len(room.chatSessions) == 0 {
+			onEmpty(room)
+			return
+		}
+	}
+}
+
+// Adds a session to the room and sends it everyone who's online. Anything that needs the database, such as chat
+// history, is sent by the caller after joining, so that the hub never waits on queries.
+func (room *ChatRoom) addSession(session *ChatSession) {
+	room.chatSessions[session] = true
+	room.deliver(session, newServerMessage(models.WsTypePresence, &models.Presence{
+		Users: room.onlineUsers(),
+	}))
+
+	// Users with several sessions in the room, e.g. in multiple tabs, only join once
+	if room.sessionCount(session.UserName) == 1 {
+		room.fanOut(session, newServerMessage(models.WsTypeJoin, &models.PresenceEvent{
+			UserName: session.UserName,
+		}))
+	}
+}
+
+// Returns the names of everyone in the room, sorted
+func (room *ChatRoom) onlineUsers() []string {
+	users := []string{}
+	seen := make(map[string]bool)
+	for session := range room.chatSessions {
+		if !seen[session.UserName] {
+			seen[session.UserName] = true
+			users = append(users, session.UserName)
+		}
+	}
+	sort.Strings(users)
+	return users
+}
+
+// Returns how many sessions a user has in the room
+func (room *ChatRoom) sessionCount(userName string) int {
+	count := 0
+	for session := range room.chatSessions {
+		if session.UserName == userName {
+			count++
+		}
+	}
+	return count
+}
+
+// Queues a message for a single session, if it is still in the room
+func (room *ChatRoom) deliver(session *ChatSession, message *models.WsServerMessage) {
+	if _, ok := room.chatSessions[session]; !ok {
+		return
+	}
+	if !session.queue(message) {
+		log.Println("Disconnecting " + session.UserName + " for falling too far behind")
+		room.removeSession(session, websocket.CloseTryAgainLater, "Too many unsent messages")
+	}
+}
+
+// Queues a message for every session except the excluded one. Sessions that can't keep up with the room are
+// disconnected, so that one slow client doesn't hold up everyone else.
+func (room *ChatRoom) fanOut(exclude *ChatSession, message *models.WsServerMessage) {
+	var slow []*ChatSession
+	for session := range room.chatSessions {
+		if session == exclude {
+			continue
+		}
+		if !session.queue(message) {
+			slow = append(slow, session)
+		}
+	}
+	for _, session := range slow {
+		log.Println("Disconnecting " + session.UserName + " for falling too far behind")
+		room.removeSession(session, websocket.CloseTryAgainLater, "Too many unsent messages")
+	}
+}
+
+func (room *ChatRoom) fanOutToThread(parentId int, message *models.WsServerMessage) {
+	for session := range room.chatSessions {
+		if session.threads[parentId] {
+			room.deliver(session, message)
+		}
+	}
+}
+
+// Starts, renews or stops a session's typing indicator. Only changes are sent to the rest of the room.
+func (room *ChatRoom) setTyping(session *ChatSession, typing bool) {
+	if _, ok := room.chatSessions[session]; !ok {
+		return
+	}
+	_, wasTyping := room.typing[session]
+	if typing {
+		room.typing[session] = time.Now().Add(typingTimeout)
+	} else {
+		delete(room.typing, session)
+	}
+	if typing != wasTyping {
+		room.fanOut(session, newServerMessage(models.WsTypeTyping, &models.TypingEvent{
+			UserName: session.UserName,
+			Typing:   typing,
+		}))
+	}
+}
+
+// Removes a session from the room, closes its connection, and lets everyone else know the user left
+func (room *ChatRoom) removeSession(session *ChatSession, closeCode int, closeReason string) {
+	if _, ok := room.chatSessions[session]; !ok {
+		// Already removed, e.g. after falling behind
+		return
+	}
+	room.setTyping(session, false)
+	delete(room.chatSessions, session)
+	session.close(closeCode, closeReason)
+
+	if room.sessionCount(session.UserName) == 0 {
+		room.fanOut(nil, newServerMessage(models.WsTypeLeave, &models.PresenceEvent{
+			UserName: session.UserName,
+		}))
+	}
+}
+
+// Sends a session to the hub. Returns false if the hub has already shut down.
+func (room *ChatRoom) join(session *ChatSession) bool {
+	select {
+	case room.register <- session:
+		return true
+	case <-room.done:
+		return false
+	}
+}
+
+func (room *ChatRoom) leave(session *ChatSession) {
+	select {
+	case room.unregister <- session:
+	case <-room.done:
+	}
+}
+
+func (room *ChatRoom) send(message *roomBroadcast) {
+	select {
+	case room.broadcast <- message:
+	case <-room.done:
+	}
+}
+
+// Sends a message to a single session through the hub
+func (room *ChatRoom) sendTo(session *ChatSession, message *models.WsServerMessage) {
+	room.send(&roomBroadcast{
+		recipient: session,
+		message:   message,
+	})
+}
+
+// Starts or stops sending a thread's replies to a session
+func (room *ChatRoom) subscribe(session *ChatSession, parentId int, subscribe bool) {
+	select {
+	case room.subscriptions <- &threadSubscription{session: session, parentId: parentId, subscribe: subscribe}:
+	case <-room.done:
+	}
+}
+
+func (room *ChatRoom) updateTyping(session *ChatSession, typing bool) {
+	select {
+	case room.typingUpdates <- &typingUpdate{session: session, typing: typing}:
+	case <-room.done:
+	}
+}
+
+func (room *ChatRoom) kick(userName string, closeCode int, reason string) {
+	select {
+	case room.kicks <- &roomKick{userName: userName, closeCode: closeCode, reason: reason}:
+	case <-room.done:
+	}
+}
+
+// Disconnects a single session, rather than all of a user's sessions like kick
+func (room *ChatRoom) disconnect(session *ChatSession, closeCode int, reason string) {
+	select {
+	case room.kicks <- &roomKick{session: session, closeCode: closeCode, reason: reason}:
+	case <-room.done:
+	}
+}
+
+// Returns the names of everyone in the room, or nil if the hub has shut down
+func (room *ChatRoom) roster() []string {
+	reply := make(chan []string, 1)
+	select {
+	case room.rosterRequests <- reply:
+		return <-reply
+	case <-room.done:
+		return nil
+	}
+}
@@ -28,7 +28,7 @@ type ServiceError struct {
 }
 
 func (serviceErr *ServiceError) Error() string {
-	return fmt.Sprintf("HTTP Code: %s, Message: %s", serviceErr.Code, serviceErr.Message)
+	return fmt.Sprintf("HTTP Code: %d, Message: %s", serviceErr.Code, serviceErr.Message)
 }
 
 func NewAuthenticationService(secureCookie *securecookie.SecureCookie, repo *repository.Repository) *AuthService {
@@ -0,0 +1,175 @@
+package chat
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Number of messages that can be waiting to be written to a client before it is considered too slow to keep up
+	sendQueueSize = 64
+)
+
+// Timeouts and limits for websocket connections
+type WebSocketConfig struct {
+	// How often to ping the client
+	PingInterval time.Duration
+	// How long to wait for a pong (or any other message) before the connection is considered dead. Must be longer
+	// than PingInterval.
+	PongTimeout time.Duration
+	// How long a single write may take
+	WriteTimeout time.Duration
+	// How long a client can go without sending a message before it is disconnected. Zero disables the timeout.
+	IdleTimeout time.Duration
+	// Largest message in bytes the client is allowed to send
+	MaxMessageSize int64
+	// Users can send MessageBurst chat messages in a row, and after that one every MessageInterval. Zero turns
+	// the limit off.
+	MessageInterval time.Duration
+	MessageBurst    int
+}
+
+func DefaultWebSocketConfig() *WebSocketConfig {
+	return &WebSocketConfig{
+		PingInterval:    30 * time.Second,
+		PongTimeout:     60 * time.Second,
+		WriteTimeout:    10 * time.Second,
+		IdleTimeout:     30 * time.Minute,
+		MaxMessageSize:  8192,
+		MessageInterval: time.Second,
+		MessageBurst:    5,
+	}
+}
+
+type ChatSession struct {
+	UserName string
+	UserConn *websocket.Conn
+	config   *WebSocketConfig
+
+	// Unix time in nanoseconds of the last message read from the client, accessed atomically
+	lastActive int64
+
+	// Messages waiting to be written by the session's write pump. Once the session has joined a room, only the
+	// room's hub may send to this channel.
+	send chan *models.WsServerMessage
+	// Closed to stop the write pump. Anything still waiting in the send queue is dropped, so that the close frame
+	// goes out straight away, even to clients that have fallen behind.
+	closing chan struct{}
+
+	// Parent message IDs of the threads the session is subscribed to. Owned by the room's hub.
+	threads map[int]bool
+
+	// Sent to the client in a close frame once closing is closed
+	closeCode   int
+	closeReason string
+}
+
+// Creates a session for a websocket connection and starts its write pump
+func newChatSession(userName string, conn *websocket.Conn, config *WebSocketConfig) *ChatSession {
+	session := &ChatSession{
+		UserName:   userName,
+		UserConn:   conn,
+		config:     config,
+		lastActive: time.Now().UnixNano(),
+		send:       make(chan *models.WsServerMessage, sendQueueSize),
+		closing:    make(chan struct{}),
+		threads:    make(map[int]bool),
+	}
+
+	// Every pong pushes back the read deadline, so connections that stop answering pings time out
+	conn.SetReadLimit(config.MaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(config.PongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(config.PongTimeout))
+	})
+
+	go session.writePump()
+	return session
+}
+
+// Reads the next message from the client, and marks the session as active
+func (session *ChatSession) readMessage() ([]byte, error) {
+	_, data, err := session.UserConn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+	return data, session.UserConn.SetReadDeadline(time.Now().Add(session.config.PongTimeout))
+}
+
+func (session *ChatSession) isIdle() bool {
+	if session.config.IdleTimeout == 0 {
+		return false
+	}
+	lastActive := time.Unix(0, atomic.LoadInt64(&session.lastActive))
+	return time.Since(lastActive) > session.config.IdleTimeout
+}
+
+// Queues a message for the client without blocking. Returns false if the queue is full.
+func (session *ChatSession) queue(message *models.WsServerMessage) bool {
+	select {
+	case session.send <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stops the write pump, which sends a close frame with the given code and reason before closing the connection
+func (session *ChatSession) close(code int, reason string) {
+	session.closeCode = code
+	session.closeReason = reason
+	close(session.closing)
+}
+
+// The write pump is the only goroutine that writes to the connection once the session has been created, since
+// gorilla websocket connections don't support concurrent writers. It also pings the client on an interval, and
+// disconnects clients that have been idle for too long.
+func (session *ChatSession) writePump() {
+	ticker := time.NewTicker(session.config.PingInterval)
+	defer ticker.Stop()
+	// Closing the connection makes the read loop fail, which removes the session from its room
+	defer session.UserConn.Close()
+
+	for {
+		// Check for a close first, since select picks at random when the send queue also has messages waiting
+		select {
+		case <-session.closing:
+			session.writeClose(session.closeCode, session.closeReason)
+			return
+		default:
+		}
+
+		select {
+		case <-session.closing:
+			session.writeClose(session.closeCode, session.closeReason)
+			return
+		case message := <-session.send:
+			session.UserConn.SetWriteDeadline(time.Now().Add(session.config.WriteTimeout))
+			if err := session.UserConn.WriteJSON(message); err != nil {
+				log.Println("Unable to send message to " + session.UserName + ": " + err.Error())
+				return
+			}
+		case <-ticker.C:
+			if session.isIdle() {
+				log.Println("Disconnecting idle user " + session.UserName)
+				session.writeClose(websocket.CloseGoingAway, "Idle timeout")
+				return
+			}
+			session.UserConn.SetWriteDeadline(time.Now().Add(session.config.WriteTimeout))
+			if err := session.UserConn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.Println("Unable to ping " + session.UserName + ": " + err.Error())
+				return
+			}
+		}
+	}
+}
+
+func (session *ChatSession) writeClose(code int, reason string) {
+	closeMessage := websocket.FormatCloseMessage(code, reason)
+	session.UserConn.WriteControl(websocket.CloseMessage, closeMessage, time.Now().Add(session.config.WriteTimeout))
+}
@@ -0,0 +1,132 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/eshyong/chatapp/chat/models"
+	"github.com/eshyong/chatapp/chat/repository"
+	"github.com/eshyong/chatapp/chat/utils"
+	"github.com/gorilla/mux"
+)
+
+// Finds the message that starts a thread. Threads can't be nested, so replies can't have replies of their own.
+func (app *Application) findThreadParent(roomId, parentId int) (*models.ChatMessage, *appError) {
+	parent, err := app.repository.FindChatMessage(roomId, parentId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, newAppError(http.StatusNotFound, "Could not find message with that ID")
+		}
+		log.Println(err)
+		return nil, internalError()
+	}
+	if parent.ParentId != 0 {
+		return nil, newAppError(http.StatusBadRequest, "Can't reply to a reply")
+	}
+	return parent, nil
+}
+
+func (app *Application) getThread(roomId, parentId int, query *models.HistoryQuery) (*models.Thread, *appError) {
+	if err := validateHistoryQuery(query); err != nil {
+		return nil, newAppError(http.StatusBadRequest, err.Error())
+	}
+	parent, appErr := app.findThreadParent(roomId, parentId)
+	if appErr != nil {
+		return nil, appErr
+	}
+	replies, err := app.repository.GetThreadReplies(parentId, query)
+	if err != nil {
+		if err == repository.ErrUnknownCursor {
+			return nil, newAppError(http.StatusBadRequest, err.Error())
+		}
+		log.Println(err)
+		return nil, internalError()
+	}
+	return &models.Thread{
+		Parent:  parent,
+		Replies: replies,
+	}, nil
+}
+
+// Sends a new reply to everyone following its thread, and the thread's new reply count to the whole room
+func (app *Application) broadcastReply(req *clientRequest, reply *models.ChatMessage) {
+	// Replying to a thread subscribes to it, which also gets the sender the canonical version of the reply
+	req.room.subscribe(req.session, reply.ParentId, true)
+	req.room.send(&roomBroadcast{
+		thread:  reply.ParentId,
+		message: newServerMessage(models.WsTypeMessage, reply),
+	})
+
+	parent, err := app.repository.FindChatMessage(req.room.roomId, reply.ParentId)
+	if err != nil {
+		log.Println("Unable to count replies: " + err.Error())
+		return
+	}
+	req.room.send(&roomBroadcast{
+		message: newServerMessage(models.WsTypeThreadUpdate, &models.ThreadUpdate{
+			ParentId:   parent.Id,
+			ReplyCount: parent.ReplyCount,
+		}),
+	})
+}
+
+func (app *Application) threadHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		log.Println("GET /api/chatroom/" + vars["name"] + "/messages/" + vars["id"] + "/thread")
+		parentId, err := strconv.Atoi(vars["id"])
+		if err != nil {
+			http.Error(w, "Message ID must be a number", http.StatusBadRequest)
+			return
+		}
+		query, err := parseHistoryQuery(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		roomModel, appErr := app.findChatRoom(app.currentUser(r), vars["name"])
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+
+		thread, appErr := app.getThread(roomModel.Id, parentId, query)
+		if appErr != nil {
+			http.Error(w, appErr.Message, appErr.Code)
+			return
+		}
+		utils.WriteJsonResponse(w, thread)
+	})
+}
+
+// Handles thread queries and subscriptions sent over the websocket
+func (app *Application) handleThreadRequest(req *clientRequest, messageType string, body json.RawMessage) {
+	query := &models.ThreadQuery{}
+	if err := json.Unmarshal(body, query); err != nil {
+		req.replyError("Unable to parse thread query")
+		return
+	}
+
+	switch messageType {
+	case models.WsTypeThread:
+		thread, appErr := app.getThread(req.room.roomId, query.ParentId, &query.HistoryQuery)
+		if appErr != nil {
+			req.replyError(appErr.Message)
+			return
+		}
+		req.reply(newServerMessage(models.WsTypeThread, thread))
+	case models.WsTypeThreadSubscribe:
+		if _, appErr := app.findThreadParent(req.room.roomId, query.ParentId); appErr != nil {
+			req.replyError(appErr.Message)
+			return
+		}
+		req.room.subscribe(req.session, query.ParentId, true)
+		req.reply(newServerMessage(models.WsTypeAck, &models.Ack{MessageId: query.ParentId}))
+	case models.WsTypeThreadUnsubscribe:
+		req.room.subscribe(req.session, query.ParentId, false)
+		req.reply(newServerMessage(models.WsTypeAck, &models.Ack{MessageId: query.ParentId}))
+	}
+}
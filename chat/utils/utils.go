@@ -18,3 +18,14 @@ func UnmarshalJsonRequest(r *http.Request, model interface{}) error {
 	}
 	return nil
 }
+
+func WriteJsonResponse(w http.ResponseWriter, model interface{}) {
+	body, err := json.Marshal(model)
+	if err != nil {
+		http.Error(w, "Unable to send JSON response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -1,6 +1,27 @@
 import React, { Component } from 'react';
 
 const ABNORMAL_CLOSURE_ERR = 1006;
+// Sent when a moderator kicks or bans us
+const POLICY_VIOLATION = 1008;
+const PROTOCOL_VERSION = 1;
+const RECONNECT_DELAY_MS = 2000;
+// The server stops typing indicators after 5 seconds, so renew them a bit more often than that
+const TYPING_RENEW_MS = 3000;
+
+const MODERATION_VERBS = {
+  kick: 'kicked',
+  ban: 'banned',
+  mute: 'muted',
+  unmute: 'unmuted',
+};
+
+function moderationNotice(type, event) {
+  let notice = `${event.userName} was ${MODERATION_VERBS[type]} by ${event.moderatedBy}`;
+  if (event.reason) {
+    notice += `: ${event.reason}`;
+  }
+  return notice;
+}
 
 class ChatRooms extends Component {
   constructor(props) {
@@ -10,6 +31,9 @@ class ChatRooms extends Component {
       error: false,
       errorMessage: '',
       newRoomName: '',
+      newRoomPrivate: false,
+      directParticipants: '',
+      inviteToken: '',
     }
   }
 
@@ -58,7 +82,7 @@ class ChatRooms extends Component {
       method: 'POST',
       body: JSON.stringify({
         roomName: this.state.newRoomName,
-        createdBy: this.props.userName
+        visibility: this.state.newRoomPrivate ? 'private' : 'public'
       }),
       headers: { 'Content-Type': 'application/json' },
       credentials: 'same-origin'
@@ -76,6 +100,62 @@ class ChatRooms extends Component {
     });
   };
 
+  // Starts a direct conversation with a comma separated list of users, or finds the existing one
+  createDirectRoom = (event) => {
+    event.preventDefault();
+    let participants = this.state.directParticipants.split(',')
+      .map((userName) => userName.trim())
+      .filter((userName) => userName);
+    if (participants.length === 0) {
+      this.showError('Enter at least one user to message');
+      return;
+    }
+
+    fetch('/api/direct', {
+      method: 'POST',
+      body: JSON.stringify({ participants: participants }),
+      headers: { 'Content-Type': 'application/json' },
+      credentials: 'same-origin'
+    })
+    .then((response) => {
+      if (response.ok) {
+        response.json().then((room) => {
+          this.setState({ error: false });
+          this.fetchRooms();
+          this.props.joinChatRoom(room.roomName);
+        });
+      } else {
+        response.text().then(this.showError);
+      }
+    });
+  };
+
+  // Joins a private room with an invite token from one of its owners
+  acceptInvite = (event) => {
+    event.preventDefault();
+    let token = this.state.inviteToken.trim();
+    if (!token) {
+      this.showError('Invite must not be empty');
+      return;
+    }
+
+    fetch(`/api/invite/${encodeURIComponent(token)}/accept`, {
+      method: 'POST',
+      credentials: 'same-origin'
+    })
+    .then((response) => {
+      if (response.ok) {
+        response.json().then((room) => {
+          this.setState({ error: false });
+          this.fetchRooms();
+          this.props.joinChatRoom(room.roomName);
+        });
+      } else {
+        response.text().then(this.showError);
+      }
+    });
+  };
+
   render() {
     let chatRoomList,
         errorStyling = { color: 'red' };
@@ -84,10 +164,14 @@ class ChatRooms extends Component {
       chatRoomList = <p><i>No chat rooms available. Try creating one above!</i></p>;
     } else {
       let chatRoomLinks = this.state.chatRooms.map((room) => {
-        let roomLink = encodeURI(`/chatroom/${room.roomName}`);
+        let roomLink = encodeURI(`/chatroom/${room.roomName}`),
+            // Direct conversations are shown by who's in them
+            label = room.direct ? (room.members || []).filter((userName) => userName !== this.props.userName).join(', ') : room.roomName;
         return (
           <li key={room.id}>
-            <a href={roomLink} onClick={this.props.joinChatRoomHandler}>{room.roomName}</a>
+            <a href={roomLink} data-room-name={room.roomName} onClick={this.props.joinChatRoomHandler}>{label}</a>
+            {!room.direct && room.visibility === 'private' && <i> (private)</i>}
+            {room.unreadCount > 0 && <b> ({room.unreadCount})</b>}
           </li>
         )
       });
@@ -101,6 +185,25 @@ class ChatRooms extends Component {
         </p>
         <form onSubmit={this.createChatRoom}>
           <input className="newRoomName" type="text" placeholder="Room name" onKeyUp={this.onKeyUp}/>
+          <label>
+            <input type="checkbox" checked={this.state.newRoomPrivate}
+                   onChange={(event) => this.setState({ newRoomPrivate: event.target.checked })}/>
+            Private
+          </label>
+          <input type="submit"/>
+        </form>
+        <p>
+          <b>Message someone directly</b>
+        </p>
+        <form onSubmit={this.createDirectRoom}>
+          <input className="directParticipants" type="text" placeholder="Usernames, separated by commas" onKeyUp={this.onKeyUp}/>
+          <input type="submit"/>
+        </form>
+        <p>
+          <b>Join with an invite</b>
+        </p>
+        <form onSubmit={this.acceptInvite}>
+          <input className="inviteToken" type="text" placeholder="Invite" onKeyUp={this.onKeyUp}/>
           <input type="submit"/>
         </form>
         {this.state.error && (
@@ -133,6 +236,9 @@ class ChatWindow extends Component {
 
   setUserInput = (event) => {
     this.setState({ newMessage: event.target.value });
+    if (event.target.value) {
+      this.props.sendTypingIndicator();
+    }
   };
 
   sendUserMessage = (event) => {
@@ -170,7 +276,15 @@ class ChatWindow extends Component {
     let messages = this.props.messages.map((message, index) => {
       // Create a classname for the message so we can query for it in componentDidUpdate
       let className = 'message' + index,
-          formattedMessage = message.sentBy + ': ' + message.contents;
+          contents = message.deleted ? '[deleted]' : message.contents,
+          formattedMessage = message.sentBy + ': ' + contents + (message.editedAt ? ' (edited)' : ''),
+          reactions = (message.reactions || []).map((reaction) => `${reaction.emoji} ${reaction.count}`).join(' ');
+      if (reactions) {
+        formattedMessage += ' [' + reactions + ']';
+      }
+      if (message.replyCount) {
+        formattedMessage += ` (${message.replyCount} ${message.replyCount === 1 ? 'reply' : 'replies'})`;
+      }
       return <div className={className} key={index}>{formattedMessage}</div>
     });
 
@@ -180,14 +294,37 @@ class ChatWindow extends Component {
           <b>
             {this.props.chatRoomHeader ? this.props.chatRoomHeader : 'Chat here'}
           </b>
+          {this.props.chatRoom && this.props.chatRoom.archived && <i> (archived)</i>}
+          {this.props.onlineUsers.length > 0 && (
+            <span> (online: {this.props.onlineUsers.join(', ')})</span>
+          )}
         </p>
+        {this.props.chatRoom && this.props.chatRoom.topic && (
+          <p><i>{this.props.chatRoom.topic}</i></p>
+        )}
+        {this.props.pins.length > 0 && (
+          <div className="pins">
+            <b>Pinned</b>
+            {this.props.pins.map((pin) => (
+              <div key={pin.message.id}>{pin.message.sentBy}: {pin.message.contents}</div>
+            ))}
+          </div>
+        )}
         <div className="chatContainer" style={containerStyling}>
           <div className="chatMessages" style={messagesStyling}>
+            {this.props.hasOlderMessages && (
+              <a href="#" onClick={this.props.loadOlderMessages}>Load older messages</a>
+            )}
             {messages}
           </div>
-          <form className="textBox" onSubmit={this.sendUserMessage}>
-            <input className="userInput" type="text" style={textStyling} onKeyUp={this.setUserInput}/>
-          </form>
+          {this.props.typingUsers.length > 0 && (
+            <i>{this.props.typingUsers.join(', ')} {this.props.typingUsers.length === 1 ? 'is' : 'are'} typing...</i>
+          )}
+          {!(this.props.chatRoom && this.props.chatRoom.archived) && (
+            <form className="textBox" onSubmit={this.sendUserMessage}>
+              <input className="userInput" type="text" style={textStyling} onKeyUp={this.setUserInput}/>
+            </form>
+          )}
         </div>
       </div>
     )
@@ -198,10 +335,16 @@ class ChatApp extends Component {
   constructor(props) {
     super(props);
     this.state = {
+      chatRoom: null,
       chatRoomHeader: '',
+      pins: [],
       error: false,
       errorMessage: '',
+      hasOlderMessages: false,
       messages: [],
+      notice: '',
+      onlineUsers: [],
+      typingUsers: [],
       webSocketConn: null,
       userName: '',
     };
@@ -246,22 +389,51 @@ class ChatApp extends Component {
   joinChatRoomHandler = (event) => {
     event.preventDefault();
 
-    this.joinChatRoom(event.target.innerHTML);
+    this.joinChatRoom(event.target.dataset.roomName);
   };
 
   joinChatRoom(roomName) {
     let apiEndpoint = `/api/chatroom/${roomName}/join`;
 
-    this.setState({ chatRoomHeader: roomName });
+    // Clear chat history when switching rooms
+    this.resuming = false;
+    this.lastReadId = 0;
+    this.setState({
+      chatRoom: null,
+      chatRoomHeader: roomName,
+      pins: [],
+      hasOlderMessages: false,
+      messages: [],
+      typingUsers: [],
+    });
     this.createWebSocketConnection(apiEndpoint);
 
     window.localStorage.setItem('lastRoomJoined', roomName);
     window.history.pushState({}, '', `/chatroom/${roomName}`);
   };
 
+  removePin = (messageId) => {
+    this.setState((state) => ({
+      pins: state.pins.filter((pin) => pin.message.id !== messageId)
+    }));
+  };
+
+  // Keeps up with the room's details. Rooms can be renamed, and joining by an old name ends up in the renamed room.
+  updateChatRoom = (chatRoom) => {
+    if (chatRoom.roomName !== this.state.chatRoomHeader) {
+      window.localStorage.setItem('lastRoomJoined', chatRoom.roomName);
+      window.history.replaceState({}, '', `/chatroom/${chatRoom.roomName}`);
+    }
+    this.setState({
+      chatRoom: chatRoom,
+      chatRoomHeader: chatRoom.roomName,
+    });
+  };
+
   createWebSocketConnection = (relativeUrl) => {
     this.clearError();
     if (this.state.webSocketConn) {
+      this.state.webSocketConn.intentionalClose = true;
       this.state.webSocketConn.close();
     }
 
@@ -270,43 +442,244 @@ class ChatApp extends Component {
     }
     let webSocket = new WebSocket(`wss://${window.location.host}${relativeUrl}`);
     webSocket.onclose = (event) => {
+      if (webSocket.intentionalClose) {
+        return;
+      }
       if (event.code === ABNORMAL_CLOSURE_ERR) {
         this.showError('Could not connect to chat server');
       }
+      if (event.code === POLICY_VIOLATION) {
+        // Kicked or banned by a moderator, so reconnecting wouldn't help
+        this.showError(event.reason);
+        return;
+      }
+      setTimeout(this.reconnect, RECONNECT_DELAY_MS);
     };
 
     webSocket.onmessage = (event) => {
       let response = JSON.parse(event.data);
-      if (response.error) {
-        this.showError(response.reason);
-        return;
+      switch (response.type) {
+        case 'error':
+          this.showError(response.reason);
+          break;
+        case 'history':
+          this.addMessages(response.body.messages);
+          if (this.resuming) {
+            // Keep fetching missed messages until we've caught up. The next page starts after the last message in
+            // this one, not the newest message we have, since live messages may have arrived in between.
+            if (response.body.hasMore) {
+              let page = response.body.messages;
+              this.requestHistory({ after: page[page.length - 1].id });
+            } else {
+              this.resuming = false;
+            }
+          } else {
+            this.setState({ hasOlderMessages: response.body.hasMore });
+          }
+          break;
+        case 'message':
+          this.addMessages(response.body);
+          break;
+        case 'edit':
+        case 'delete':
+          this.replaceMessage(response.body);
+          if (response.body.deleted) {
+            this.removePin(response.body.id);
+          }
+          break;
+        case 'pins':
+          this.setState({ pins: response.body.pins });
+          break;
+        case 'pin':
+          this.setState((state) => ({
+            pins: state.pins.filter((pin) => pin.message.id !== response.body.message.id).concat(response.body)
+          }));
+          break;
+        case 'unpin':
+          this.removePin(response.body.message.id);
+          break;
+        case 'reactions':
+          this.updateReactions(response.body);
+          break;
+        case 'presence':
+          this.setState({ onlineUsers: response.body.users });
+          break;
+        case 'join':
+          this.setState({
+            onlineUsers: this.state.onlineUsers
+              .filter((userName) => userName !== response.body.userName)
+              .concat(response.body.userName)
+              .sort()
+          });
+          break;
+        case 'leave':
+          this.setState({
+            onlineUsers: this.state.onlineUsers.filter((userName) => userName !== response.body.userName)
+          });
+          break;
+        case 'typing':
+          this.updateTypingUsers(response.body);
+          break;
+        case 'mention':
+          this.setState({
+            notice: `${response.body.message.sentBy} mentioned you in ${response.body.roomName}`
+          });
+          break;
+        case 'kick':
+        case 'ban':
+        case 'mute':
+        case 'unmute':
+          this.setState({ notice: moderationNotice(response.type, response.body) });
+          break;
+        case 'room_updated':
+          this.updateChatRoom(response.body);
+          break;
+        case 'room_deleted':
+          // The server is about to disconnect us, and there's nothing to reconnect to
+          webSocket.intentionalClose = true;
+          window.localStorage.removeItem('lastRoomJoined');
+          this.setState({
+            chatRoom: null,
+            chatRoomHeader: '',
+            messages: [],
+            pins: [],
+            notice: `${response.body.roomName} was deleted`
+          });
+          break;
+        case 'slow_mode':
+          this.setState({
+            notice: response.body.seconds
+              ? `${response.body.setBy} turned on slow mode: one message every ${response.body.seconds} seconds`
+              : `${response.body.setBy} turned off slow mode`
+          });
+          break;
+        case 'thread_update':
+          this.updateMessage(response.body.parentId, { replyCount: response.body.replyCount });
+          break;
+        default:
+          // Ignore events the UI doesn't show yet
+          break;
       }
-      this.setState({ messages: this.state.messages.concat(response.body) });
     };
 
     webSocket.onopen = () => {
-      this.setState({
-        // Clear chat history when switching rooms
-        messages: [],
-        webSocketConn: webSocket
-      });
+      this.setState({ webSocketConn: webSocket });
     };
   };
 
+  // Rejoins the current room after losing the connection, asking only for the messages we missed
+  reconnect = () => {
+    if (!this.state.chatRoomHeader) {
+      return;
+    }
+    let apiEndpoint = `/api/chatroom/${this.state.chatRoomHeader}/join`,
+        lastMessageId = this.lastMessageId();
+    if (lastMessageId) {
+      this.resuming = true;
+      apiEndpoint += `?lastSeen=${lastMessageId}`;
+    }
+    this.createWebSocketConnection(apiEndpoint);
+  };
+
+  lastMessageId = () => {
+    let messages = this.state.messages;
+    return messages.length > 0 ? messages[messages.length - 1].id : 0;
+  };
+
+  requestHistory = (query) => {
+    this.state.webSocketConn.send(JSON.stringify({
+      version: PROTOCOL_VERSION,
+      type: 'history',
+      body: query,
+    }));
+  };
+
+  addMessages = (newMessages) => {
+    // Skip messages we already have, e.g. after reconnecting
+    let seen = new Set(this.state.messages.map((message) => message.id));
+    newMessages = [].concat(newMessages).filter((message) => !seen.has(message.id));
+    let messages = this.state.messages.concat(newMessages);
+    messages.sort((a, b) => a.id - b.id);
+    this.setState({ messages: messages });
+    this.sendReadReceipt(messages);
+  };
+
+  // Lets the server know we've seen everything up to the newest message
+  sendReadReceipt = (messages) => {
+    let newest = messages[messages.length - 1];
+    if (!newest || !this.state.webSocketConn || newest.id <= (this.lastReadId || 0)) {
+      return;
+    }
+    this.lastReadId = newest.id;
+    this.state.webSocketConn.send(JSON.stringify({
+      version: PROTOCOL_VERSION,
+      type: 'read',
+      body: { messageId: newest.id },
+    }));
+  };
+
+  replaceMessage = (updatedMessage) => {
+    let messages = this.state.messages.map((message) => {
+      return message.id === updatedMessage.id ? updatedMessage : message;
+    });
+    this.setState({ messages: messages });
+  };
+
+  updateReactions = (event) => {
+    this.updateMessage(event.messageId, { reactions: event.reactions });
+  };
+
+  updateTypingUsers = (event) => {
+    let typingUsers = this.state.typingUsers.filter((userName) => userName !== event.userName);
+    if (event.typing) {
+      typingUsers.push(event.userName);
+    }
+    this.setState({ typingUsers: typingUsers });
+  };
+
+  sendTypingIndicator = () => {
+    let now = Date.now();
+    if (!this.state.webSocketConn || now - (this.lastTypingSent || 0) < TYPING_RENEW_MS) {
+      return;
+    }
+    this.lastTypingSent = now;
+    this.state.webSocketConn.send(JSON.stringify({
+      version: PROTOCOL_VERSION,
+      type: 'typing',
+      body: { typing: true },
+    }));
+  };
+
+  updateMessage = (id, fields) => {
+    let messages = this.state.messages.map((message) => {
+      return message.id === id ? Object.assign({}, message, fields) : message;
+    });
+    this.setState({ messages: messages });
+  };
+
+  loadOlderMessages = (event) => {
+    event.preventDefault();
+    if (!this.state.webSocketConn || this.state.messages.length === 0) {
+      return;
+    }
+    this.requestHistory({ before: this.state.messages[0].id });
+  };
+
   sendWebSocketChatMessage = (contents) => {
     if (!this.state.chatRoomHeader) {
       this.showError('You are not in any chat room');
       return;
     }
 
-    let message = {
-      contents: contents,
-      sentBy: this.state.userName,
-      timeSent: new Date(),
-    };
-
-    this.state.webSocketConn.send(JSON.stringify(message));
-    this.setState({ messages: this.state.messages.concat(message) });
+    // The server fills in the sender and time, and echoes the message back to us. It also stops our typing
+    // indicator, so the next keystroke should start it again.
+    this.lastTypingSent = 0;
+    this.state.webSocketConn.send(JSON.stringify({
+      version: PROTOCOL_VERSION,
+      type: 'message',
+      nonce: `${Date.now()}-${Math.random()}`,
+      body: { contents: contents },
+    }));
   };
 
   render() {
@@ -332,18 +705,29 @@ class ChatApp extends Component {
         {this.state.error && (
           <div className="errorMessage" style={errorStyling}>{this.state.errorMessage}</div>
         )}
+        {this.state.notice && (
+          <div className="notice" onClick={() => this.setState({ notice: '' })}>{this.state.notice}</div>
+        )}
         <div className="container" style={containerStyling}>
           <ChatRooms
             style={chatRoomsStyling}
             userName={this.state.userName}
             joinChatRoomHandler={this.joinChatRoomHandler}
+            joinChatRoom={(roomName) => this.joinChatRoom(roomName)}
             createWebSocketConnection={this.createWebSocketConnection}
           />
           <ChatWindow
             style={chatBoxStyling}
             messages={this.state.messages}
+            hasOlderMessages={this.state.hasOlderMessages}
+            loadOlderMessages={this.loadOlderMessages}
             chatRoomHeader={this.state.chatRoomHeader}
+            chatRoom={this.state.chatRoom}
+            pins={this.state.pins}
             sendWebSocketChatMessage={this.sendWebSocketChatMessage}
+            typingUsers={this.state.typingUsers}
+            onlineUsers={this.state.onlineUsers}
+            sendTypingIndicator={this.sendTypingIndicator}
           />
         </div>
       </div>
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -71,7 +72,7 @@ func runAppServer(wg *sync.WaitGroup, httpsPort string) {
 	}
 
 	// App setup
-	app := chat.NewApp(hashKey, blockKey, env)
+	app := chat.NewApp(hashKey, blockKey, env, createWebSocketConfig())
 	server := &http.Server{
 		Addr:         ":" + httpsPort,
 		ReadTimeout:  5 * time.Second,
@@ -85,6 +86,59 @@ func runAppServer(wg *sync.WaitGroup, httpsPort string) {
 	}
 }
 
+// Reads websocket timeouts and limits from the environment, falling back to defaults for anything unset
+func createWebSocketConfig() *chat.WebSocketConfig {
+	config := chat.DefaultWebSocketConfig()
+	config.PingInterval = durationFromEnv("CHATAPP_WS_PING_INTERVAL", config.PingInterval)
+	config.PongTimeout = durationFromEnv("CHATAPP_WS_PONG_TIMEOUT", config.PongTimeout)
+	config.IdleTimeout = durationFromEnv("CHATAPP_WS_IDLE_TIMEOUT", config.IdleTimeout)
+	if maxMessageSize := os.Getenv("CHATAPP_WS_MAX_MESSAGE_SIZE"); maxMessageSize != "" {
+		size, err := strconv.ParseInt(maxMessageSize, 10, 64)
+		if err != nil || size <= 0 {
+			log.Fatal("CHATAPP_WS_MAX_MESSAGE_SIZE should be a positive number of bytes")
+		}
+		config.MaxMessageSize = size
+	}
+	config.MessageInterval = durationFromEnv("CHATAPP_WS_MESSAGE_INTERVAL", config.MessageInterval)
+	if messageBurst := os.Getenv("CHATAPP_WS_MESSAGE_BURST"); messageBurst != "" {
+		burst, err := strconv.Atoi(messageBurst)
+		if err != nil || burst <= 0 {
+			log.Fatal("CHATAPP_WS_MESSAGE_BURST should be a positive number of messages")
+		}
+		config.MessageBurst = burst
+	}
+	// A zero ping interval would make the write pump's ticker panic, and a negative idle timeout would disconnect
+	// everyone at the first ping
+	if config.PingInterval <= 0 || config.PongTimeout <= 0 {
+		log.Fatal("CHATAPP_WS_PING_INTERVAL and CHATAPP_WS_PONG_TIMEOUT should be positive durations")
+	}
+	if config.WriteTimeout <= 0 {
+		log.Fatal("Websocket write timeout should be a positive duration")
+	}
+	if config.IdleTimeout < 0 {
+		log.Fatal("CHATAPP_WS_IDLE_TIMEOUT should be 0 or a positive duration")
+	}
+	if config.MessageInterval < 0 {
+		log.Fatal("CHATAPP_WS_MESSAGE_INTERVAL should be 0 or a positive duration")
+	}
+	if config.PongTimeout <= config.PingInterval {
+		log.Fatal("CHATAPP_WS_PONG_TIMEOUT should be longer than CHATAPP_WS_PING_INTERVAL")
+	}
+	return config
+}
+
+func durationFromEnv(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatal(name+" should be a duration such as \"30s\": ", err)
+	}
+	return duration
+}
+
 func createDefaultTlsConfig() *tls.Config {
 	// TLS config taken from Filippo Valsorda's blog post:
 	// https://blog.cloudflare.com/exposing-go-on-the-internet/
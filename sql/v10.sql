@@ -0,0 +1,10 @@
+SET SCHEMA 'data';
+
+-- Each member of a room is an owner, a moderator or a regular member
+ALTER TABLE chat_member ADD COLUMN IF NOT EXISTS role varchar(16) NOT NULL DEFAULT 'member';
+
+-- Room creators own their rooms
+UPDATE chat_member SET role = 'owner'
+    FROM chat_room, chat_user
+    WHERE chat_room.id = chat_member.chat_room_id AND chat_user.id = chat_member.chat_user_id
+    AND chat_user.user_name = chat_room.created_by AND NOT chat_room.is_direct;
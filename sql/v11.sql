@@ -0,0 +1,14 @@
+SET SCHEMA 'data';
+
+-- Invite links to private rooms. An invite without max_uses can be used until it expires or is revoked.
+CREATE TABLE IF NOT EXISTS chat_invite (
+    token varchar(64) PRIMARY KEY,
+    chat_room_id integer REFERENCES chat_room,
+    created_by varchar(64),
+    created_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc'),
+    expires_at TIMESTAMP NOT NULL,
+    max_uses integer,
+    uses integer NOT NULL DEFAULT 0,
+    revoked_at TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS chat_invite_chat_room_id_idx ON chat_invite (chat_room_id);
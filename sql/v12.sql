@@ -0,0 +1,22 @@
+SET SCHEMA 'data';
+
+-- Banned users can't join a room until the ban expires. Bans without an expiry are permanent.
+CREATE TABLE IF NOT EXISTS chat_ban (
+    chat_room_id integer REFERENCES chat_room,
+    user_name varchar(64),
+    banned_by varchar(64),
+    reason varchar(256),
+    banned_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc'),
+    expires_at TIMESTAMP,
+    PRIMARY KEY (chat_room_id, user_name)
+);
+
+-- Muted members can read a room but not send messages to it. Mutes are kept apart from membership, so that leaving
+-- and rejoining a room doesn't clear them.
+CREATE TABLE IF NOT EXISTS chat_mute (
+    chat_room_id integer REFERENCES chat_room,
+    user_name varchar(64),
+    muted_by varchar(64),
+    muted_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc'),
+    PRIMARY KEY (chat_room_id, user_name)
+);
@@ -0,0 +1,4 @@
+SET SCHEMA 'data';
+
+-- In slow mode, members can only send one message every slow_mode_seconds. Zero turns it off.
+ALTER TABLE chat_room ADD COLUMN IF NOT EXISTS slow_mode_seconds integer NOT NULL DEFAULT 0;
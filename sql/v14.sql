@@ -0,0 +1,22 @@
+SET SCHEMA 'data';
+
+ALTER TABLE chat_room ADD COLUMN IF NOT EXISTS topic varchar(256) NOT NULL DEFAULT '';
+ALTER TABLE chat_room ADD COLUMN IF NOT EXISTS description varchar(1024) NOT NULL DEFAULT '';
+-- Archived rooms are read only, and aren't listed unless asked for
+ALTER TABLE chat_room ADD COLUMN IF NOT EXISTS archived boolean NOT NULL DEFAULT false;
+
+-- Existing rooms were created no later than their first message
+ALTER TABLE chat_room ADD COLUMN IF NOT EXISTS created_at TIMESTAMP;
+UPDATE chat_room SET created_at = COALESCE(
+    (SELECT min(time_sent) FROM chat_message WHERE chat_message.chat_room_id = chat_room.id),
+    now() AT TIME ZONE 'utc'
+) WHERE created_at IS NULL;
+ALTER TABLE chat_room ALTER COLUMN created_at SET DEFAULT (now() AT TIME ZONE 'utc');
+
+-- Old names of renamed rooms, so that links to them keep working
+CREATE TABLE IF NOT EXISTS chat_room_alias (
+    room_name varchar(1024) PRIMARY KEY,
+    chat_room_id integer REFERENCES chat_room,
+    renamed_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc')
+);
+CREATE INDEX IF NOT EXISTS chat_room_alias_chat_room_id_idx ON chat_room_alias (chat_room_id);
@@ -0,0 +1,9 @@
+SET SCHEMA 'data';
+
+CREATE TABLE IF NOT EXISTS chat_pin (
+    chat_message_id integer PRIMARY KEY REFERENCES chat_message,
+    chat_room_id integer REFERENCES chat_room,
+    pinned_by varchar(64),
+    pinned_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc')
+);
+CREATE INDEX IF NOT EXISTS chat_pin_chat_room_id_idx ON chat_pin (chat_room_id);
@@ -0,0 +1,5 @@
+SET SCHEMA 'data';
+
+-- Edited and deleted messages keep their row, so that replies and history stay intact
+ALTER TABLE chat_message ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP;
+ALTER TABLE chat_message ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
@@ -0,0 +1,9 @@
+SET SCHEMA 'data';
+
+CREATE TABLE IF NOT EXISTS chat_reaction (
+    chat_message_id integer REFERENCES chat_message,
+    user_name varchar(64),
+    emoji varchar(32),
+    reacted_at TIMESTAMP DEFAULT (now() AT TIME ZONE 'utc'),
+    PRIMARY KEY (chat_message_id, user_name, emoji)
+);
@@ -0,0 +1,5 @@
+SET SCHEMA 'data';
+
+-- Replies in a thread point to the top level message that started it
+ALTER TABLE chat_message ADD COLUMN IF NOT EXISTS parent_id integer REFERENCES chat_message;
+CREATE INDEX IF NOT EXISTS chat_message_parent_id_idx ON chat_message (parent_id);
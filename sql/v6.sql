@@ -0,0 +1,5 @@
+SET SCHEMA 'data';
+
+-- Each member has a single row per room, which holds their read position
+CREATE UNIQUE INDEX IF NOT EXISTS chat_member_user_room_idx ON chat_member (chat_user_id, chat_room_id);
+ALTER TABLE chat_member ADD COLUMN IF NOT EXISTS last_read_message_id integer REFERENCES chat_message;
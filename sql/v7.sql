@@ -0,0 +1,8 @@
+SET SCHEMA 'data';
+
+CREATE TABLE IF NOT EXISTS chat_mention (
+    chat_message_id integer REFERENCES chat_message,
+    chat_user_id integer REFERENCES chat_user,
+    PRIMARY KEY (chat_message_id, chat_user_id)
+);
+CREATE INDEX IF NOT EXISTS chat_mention_chat_user_id_idx ON chat_mention (chat_user_id);
@@ -0,0 +1,4 @@
+SET SCHEMA 'data';
+
+-- Direct conversations are rooms whose members are listed in chat_member, and are only visible to them
+ALTER TABLE chat_room ADD COLUMN IF NOT EXISTS is_direct boolean NOT NULL DEFAULT false;
@@ -0,0 +1,10 @@
+SET SCHEMA 'data';
+
+-- Private rooms can only be seen and joined by their members. Direct conversations are always private.
+ALTER TABLE chat_room ADD COLUMN IF NOT EXISTS visibility varchar(16) NOT NULL DEFAULT 'public';
+UPDATE chat_room SET visibility = 'private' WHERE is_direct;
+
+-- Room creators are members of their rooms
+INSERT INTO chat_member (chat_user_id, chat_room_id)
+    SELECT chat_user.id, chat_room.id FROM chat_room JOIN chat_user ON chat_user.user_name = chat_room.created_by
+    ON CONFLICT (chat_user_id, chat_room_id) DO NOTHING;